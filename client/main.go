@@ -7,7 +7,9 @@ import (
 	"log"
 	"logkv/protocol"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/davyxu/cellnet"
 	"github.com/davyxu/cellnet/peer"
@@ -18,6 +20,44 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+type Log struct {
+	Id     primitive.ObjectID `bson:"_id,omitempty"`
+	App    string             `bson:"app"`
+	Custom string             `bson:"custom"`
+}
+
+var streamID uint32
+
+// get, scan 等命令只返回这些字段, 用 fields 命令设置
+var fields []string
+
+// commands 每个命令至少要带的参数个数和用法, 参数不够时打印用法
+var commands = map[string]struct {
+	args  int
+	usage string
+}{
+	"set":       {1, "set <text>"},
+	"fields":    {1, "fields <field,field|->"},
+	"get":       {1, "get <key>"},
+	"bget":      {1, "bget <key> [key...]"},
+	"scan":      {1, "scan <start key> [end key]"},
+	"rscan":     {1, "rscan <end key>"},
+	"agg":       {1, "agg <interval seconds> [group,group|-] [field,field]"},
+	"filter":    {1, "filter <json>"},
+	"export":    {1, "export <start time> [end time]"},
+	"tail":      {1, "tail <resume key|-> [json]"},
+	"changes":   {1, "changes <consumer>"},
+	"commit":    {2, "commit <consumer> <segment:offset:inblock>"},
+	"replica":   {0, "replica"},
+	"unconsume": {1, "unconsume <consumer>"},
+	"cancel":    {1, "cancel <stream id>"},
+	"next":      {1, "next <cursor>"},
+	"trace":     {1, "trace <trace id> [cursor]"},
+	"find":      {2, "find <field> <value> [cursor]"},
+	"search":    {1, "search <query>"},
+	"frange":    {3, "frange <field> <start> <end|-> [cursor]"},
+}
+
 func main() {
 	var ctx, cancel = context.WithCancel(context.Background())
 	// 创建一个事件处理队列，整个客户端只有这一个队列处理事件，客户端属于单线程模型
@@ -47,9 +87,64 @@ func main() {
 			err := bson.Unmarshal(msg.Data, &v)
 			fmt.Println(v, err)
 		case *protocol.BatchGetAck:
+			for i, v := range msg.Datas {
+				fmt.Printf("%d %s %d:%s,%s\n", int(msg.Offset)+i, v.Key, v.Code, v.Message, v.Data)
+			}
+			if msg.More {
+				fmt.Println("...")
+			}
 		case *protocol.BatchSetAck:
+			log.Println(msg)
 		case *protocol.DeleteAck:
 		case *protocol.ScanAck:
+			printPage(msg.Code, msg.Message, msg.Datas, msg.Cursor)
+		case *protocol.NextAck:
+			printPage(msg.Code, msg.Message, msg.Datas, msg.Cursor)
+		case *protocol.TraceAck:
+			printPage(msg.Code, msg.Message, msg.Datas, msg.Cursor)
+		case *protocol.GetWithIndexAck:
+			printPage(msg.Code, msg.Message, msg.Datas, msg.Cursor)
+		case *protocol.ScanWithIndexAck:
+			printPage(msg.Code, msg.Message, msg.Datas, msg.Cursor)
+		case *protocol.SearchAck:
+			printPage(msg.Code, msg.Message, msg.Datas, msg.Cursor)
+		case *protocol.ChangesAck:
+			printPage(msg.Code, msg.Message, msg.Datas, "")
+			if msg.Code == 0 {
+				fmt.Printf("next %d:%d:%d\n", msg.Next.Segment, msg.Next.Offset, msg.Next.InBlock)
+			}
+		case *protocol.CommitAck:
+			fmt.Printf("%d:%s\n", msg.Code, msg.Message)
+		case *protocol.RemoveConsumerAck:
+			fmt.Printf("%d:%s\n", msg.Code, msg.Message)
+		case *protocol.ReplicaStatusAck:
+			fmt.Printf("%s offset=%d:%d:%d lag=%d bytes\n", msg.Role, msg.Offset.Segment, msg.Offset.Offset, msg.Offset.InBlock, msg.Lag)
+			if msg.Role == "follower" {
+				fmt.Printf("leader=%s connected=%v applied=%d last=%s at %s error=%s\n", msg.Leader, msg.Connected, msg.Applied,
+					msg.LastKey, time.Unix(int64(msg.LastApplied), 0).Format(time.RFC3339), msg.Error)
+			}
+			for _, c := range msg.Consumers {
+				fmt.Printf("\t%s offset=%d:%d:%d lag=%d bytes\n", c.Name, c.Offset.Segment, c.Offset.Offset, c.Offset.InBlock, c.Lag)
+			}
+		case *protocol.AggregateAck:
+			if msg.Code != 0 {
+				fmt.Printf("%d:%s\n", msg.Code, msg.Message)
+				return
+			}
+			for _, b := range msg.Buckets {
+				fmt.Println(time.Unix(int64(b.Time), 0).Format(time.RFC3339), b.Group, b.Count)
+				for _, st := range b.Stats {
+					fmt.Printf("\tcount=%d min=%v max=%v avg=%v p50,p95,p99=%v\n", st.Count, st.Min, st.Max, st.Avg, st.Percentiles)
+				}
+			}
+		case *protocol.ScanChunk:
+			printPage(msg.Code, msg.Message, msg.Datas, "")
+			if msg.End {
+				fmt.Println("end of stream", msg.StreamID)
+				return
+			}
+			// 处理完一块再确认, 服务端据此控制发送速度
+			ev.Session().Send(&protocol.StreamNextReq{StreamID: msg.StreamID, Seq: msg.Seq})
 		default:
 			log.Println(msg)
 		}
@@ -75,8 +170,13 @@ func main() {
 	ReadConsole(ctx, func(str string) {
 
 		s := strings.Split(str, " ")
-		if len(s) <= 1 {
-			log.Println("unkown cmd")
+		cmd, ok := commands[s[0]]
+		if !ok {
+			log.Println("unkown cmd", str)
+			return
+		}
+		if len(s)-1 < cmd.args {
+			log.Println("usage:", cmd.usage)
 			return
 		}
 		var sess = p.(interface {
@@ -84,9 +184,8 @@ func main() {
 		}).Session()
 		switch s[0] {
 		case "set":
-			key := primitive.NewObjectID()
+			// 不带_id, 由服务端分配, key 在 SetAck 里返回
 			var v = Log{
-				Id:     key,
 				App:    "main",
 				Custom: strings.Join(s[1:], " "),
 			}
@@ -99,7 +198,12 @@ func main() {
 				Data: data,
 			}
 			sess.Send(req)
-			log.Println("set", key.Hex())
+		case "fields":
+			// fields <字段,字段>, 之后的查询只返回这些字段, fields - 返回全部字段
+			fields = nil
+			if s[1] != "-" {
+				fields = strings.Split(s[1], ",")
+			}
 		case "get":
 			var key, err = primitive.ObjectIDFromHex(s[1])
 			if err != nil {
@@ -108,17 +212,183 @@ func main() {
 			}
 
 			var req = protocol.GetReq{
-				Key: key.Hex(),
+				Key:     key.Hex(),
+				Include: fields,
 			}
 
 			sess.Send(&req)
-		default:
-			log.Println("unkown cmd", str)
+		case "bget":
+			var req = protocol.BatchGetReq{
+				Keys:    s[1:],
+				Include: fields,
+			}
+			sess.Send(&req)
+		case "scan":
+			// scan <开始key> [结束key]
+			var req = protocol.ScanReq{
+				StartKey: s[1],
+				Include:  fields,
+			}
+			if len(s) > 2 {
+				req.EndKey = s[2]
+			}
+			sess.Send(&req)
+		case "rscan":
+			// rscan <结束key>, 从结束key开始倒序
+			var req = protocol.ScanReq{
+				EndKey:  s[1],
+				Reverse: true,
+				Include: fields,
+			}
+			sess.Send(&req)
+		case "agg":
+			// agg <分桶秒数> [分组字段,..] [数值字段,..], 统计所有数据
+			interval, _ := strconv.ParseUint(s[1], 10, 32)
+			var req = protocol.AggregateReq{
+				Interval:    uint32(interval),
+				Percentiles: []float64{50, 95, 99},
+			}
+			if len(s) > 2 && s[2] != "-" {
+				req.GroupBy = strings.Split(s[2], ",")
+			}
+			if len(s) > 3 {
+				req.Fields = strings.Split(s[3], ",")
+			}
+			sess.Send(&req)
+		case "filter":
+			// filter <json>, 扫描所有数据, 只返回满足条件的, 例如
+			// filter {"level": {"$in": ["error", "warn"]}, "latency_ms": {"$gt": 500}}
+			var filter bson.D
+			if err := bson.UnmarshalExtJSON([]byte(strings.Join(s[1:], " ")), false, &filter); err != nil {
+				log.Println(err)
+				return
+			}
+			data, err := bson.Marshal(filter)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			sess.Send(&protocol.ScanReq{Filter: data, Include: fields})
+		case "export":
+			// export <开始时间> <结束时间>, 秒级时间戳, 流式返回
+			start, _ := strconv.ParseUint(s[1], 10, 32)
+			var end uint64
+			if len(s) > 2 {
+				end, _ = strconv.ParseUint(s[2], 10, 32)
+			}
+			streamID++
+			var req = protocol.ScanStreamReq{
+				ScanReq:  protocol.ScanReq{StartTime: uint32(start), EndTime: uint32(end), Include: fields},
+				StreamID: streamID,
+			}
+			sess.Send(&req)
+			fmt.Println("stream", streamID)
+		case "tail":
+			// tail <续传key|-> [json], 持续推送新数据, 续传key为最后收到的key, 用 cancel 结束
+			streamID++
+			var req = protocol.SubscribeReq{
+				StreamID: streamID,
+				Include:  fields,
+			}
+			if s[1] != "-" {
+				req.Resume = s[1]
+			}
+			if len(s) > 2 {
+				var filter bson.D
+				if err := bson.UnmarshalExtJSON([]byte(strings.Join(s[2:], " ")), false, &filter); err != nil {
+					log.Println(err)
+					return
+				}
+				data, err := bson.Marshal(filter)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				req.Filter = data
+			}
+			sess.Send(&req)
+			fmt.Println("stream", streamID)
+		case "changes":
+			// changes <消费者>, 从消费者提交的位置读取一页变更, 处理完用 commit 提交返回的 next
+			sess.Send(&protocol.ChangesReq{Consumer: s[1]})
+		case "commit":
+			// commit <消费者> <段:偏移:块内偏移>
+			var off protocol.LogOffset
+			if _, err := fmt.Sscanf(s[2], "%d:%d:%d", &off.Segment, &off.Offset, &off.InBlock); err != nil {
+				log.Println(err)
+				return
+			}
+			sess.Send(&protocol.CommitReq{Consumer: s[1], Offset: off})
+		case "replica":
+			// replica status, 主节点显示各个消费者的延迟, 从节点显示复制进度
+			sess.Send(&protocol.ReplicaStatusReq{})
+		case "unconsume":
+			// unconsume <消费者>, 删除消费者, 不再为它保留数据
+			sess.Send(&protocol.RemoveConsumerReq{Consumer: s[1]})
+		case "cancel":
+			id, _ := strconv.ParseUint(s[1], 10, 32)
+			sess.Send(&protocol.StreamCancelReq{StreamID: uint32(id)})
+		case "next":
+			var req = protocol.NextReq{
+				Cursor:  s[1],
+				Include: fields,
+			}
+			sess.Send(&req)
+		case "trace":
+			// trace <链路id> [cursor], 按时间顺序返回链路下的日志
+			var req = protocol.TraceReq{
+				Trace: s[1],
+			}
+			if len(s) > 2 {
+				req.Cursor = s[2]
+			}
+			sess.Send(&req)
+		case "find":
+			// find <字段> <值> [cursor]
+			var req = protocol.GetWithIndexReq{
+				FieldName: s[1],
+				FieldVal:  s[2],
+			}
+			if len(s) > 3 {
+				req.Cursor = s[3]
+			}
+			sess.Send(&req)
+		case "search":
+			// search <查询>, 例如 search timeout "connection reset" OR panic
+			sess.Send(&protocol.SearchReq{
+				Query: strings.Join(s[1:], " "),
+			})
+		case "frange":
+			// frange <字段> <开始值> <结束值> [cursor], 结束值为 - 不限制
+			var req = protocol.ScanWithIndexReq{
+				FieldName:     s[1],
+				FieldValStart: s[2],
+			}
+			if s[3] != "-" {
+				req.FieldValEnd = s[3]
+			}
+			if len(s) > 4 {
+				req.Cursor = s[4]
+			}
+			sess.Send(&req)
 		}
 
 	})
 }
 
+func printPage(code uint32, message string, datas []protocol.GetAck, cursor string) {
+	if code != 0 {
+		fmt.Printf("%d:%s\n", code, message)
+		return
+	}
+	for _, v := range datas {
+		fmt.Printf("%s %s\n", v.Key, bson.Raw(v.Data))
+	}
+	if cursor != "" {
+		fmt.Println("next", cursor)
+	}
+}
+
 func ReadCmd() {
 
 }
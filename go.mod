@@ -7,6 +7,8 @@ require (
 	github.com/davyxu/golog v0.1.0 // indirect
 	github.com/davyxu/goobjfmt v0.1.0 // indirect
 	github.com/davyxu/protoplus v0.1.0 // indirect
+	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.9.5
 	go.mongodb.org/mongo-driver v1.7.1
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
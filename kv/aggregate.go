@@ -0,0 +1,228 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var (
+	ErrInvalidAggregate = errors.New("invalid aggregate")
+	ErrTooManyGroups    = errors.New("too many groups")
+)
+
+const (
+	// 一次聚合最多的分组数, 包括时间桶
+	maxAggGroups = 10 * 1000
+	// 一次聚合所有分组所有字段保留的样本总数, 只在需要百分位时保留
+	// 每个分组每个字段最多 maxGroupSamples 个, 分组多时减半, 超过后蓄水池抽样, 百分位为近似值
+	maxAggSamples   = 1000 * 1000
+	maxGroupSamples = 10 * 1000
+)
+
+// AggregateOptions 聚合参数, 都为空时只统计总数
+type AggregateOptions struct {
+	// 只统计满足条件的数据
+	Filter *Filter
+	// 按这些字段的值分组, 取值方式和二级索引相同
+	GroupBy []string
+	// 按key里的时间分桶, 0不分桶
+	Interval time.Duration
+	// 统计这些数值字段的最小, 最大, 平均值
+	Fields []string
+	// 数值字段的百分位, 0到100
+	Percentiles []float64
+}
+
+// AggBucket 一个时间桶里一个分组的统计
+type AggBucket struct {
+	// 时间桶开始的时间, 不分桶时为0
+	Time  int64
+	Group []string
+	Count int64
+	// 和 Fields 一一对应
+	Stats []FieldStats
+}
+
+// FieldStats 数值字段的统计, Count 为有数值的条数, 为0时其他值无意义
+type FieldStats struct {
+	Count       int64
+	Min         float64
+	Max         float64
+	Avg         float64
+	Percentiles []float64
+}
+
+type aggGroup struct {
+	bucket AggBucket
+	fields []*fieldAgg
+}
+
+type fieldAgg struct {
+	count    int64
+	min, max float64
+	sum      float64
+	samples  []float64
+}
+
+// Aggregate 按key的顺序遍历 [start, end] 内的数据做统计, 只保留每个分组的统计值, 不保存文档
+// 结果按时间, 再按分组的值排序
+func (e *KvEngine) Aggregate(start, end primitive.ObjectID, opts AggregateOptions) ([]AggBucket, error) {
+	if opts.Interval < 0 {
+		return nil, fmt.Errorf("%w: negative interval", ErrInvalidAggregate)
+	}
+	if opts.Interval > 0 && opts.Interval < time.Second {
+		return nil, fmt.Errorf("%w: interval less than a second", ErrInvalidAggregate)
+	}
+	for _, p := range opts.Percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("%w: percentile %v out of range", ErrInvalidAggregate, p)
+		}
+	}
+	var interval = int64(opts.Interval / time.Second)
+	var rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	var groups = make(map[string]*aggGroup)
+	// 每个分组每个字段的样本数上限, 不要百分位时为0
+	var sampleCap int
+	if len(opts.Percentiles) > 0 {
+		sampleCap = maxGroupSamples
+	}
+	var it = e.NewIterator(start, end, false)
+	for it.Next() {
+		var doc = bsoncore.Document(it.Value())
+		if opts.Filter != nil && !opts.Filter.Match(doc) {
+			continue
+		}
+		var ts int64
+		if interval > 0 {
+			ts = it.Key().Timestamp().Unix()
+			ts -= ts % interval
+		}
+		var values = fieldValues(doc, opts.GroupBy)
+		var name = fmt.Sprintf("%d\x00%s", ts, strings.Join(values, "\x00"))
+		g, ok := groups[name]
+		if !ok {
+			if len(groups) >= maxAggGroups {
+				return nil, fmt.Errorf("%w: more than %d", ErrTooManyGroups, maxAggGroups)
+			}
+			// 样本总数可能超过预算时上限减半, 已有的样本随机丢掉多出来的
+			var old = sampleCap
+			for sampleCap > 1 && (len(groups)+1)*len(opts.Fields)*sampleCap > maxAggSamples {
+				sampleCap /= 2
+			}
+			if sampleCap < old {
+				for _, g := range groups {
+					for _, f := range g.fields {
+						f.shrink(sampleCap, rnd)
+					}
+				}
+			}
+			g = &aggGroup{bucket: AggBucket{Time: ts, Group: values}, fields: make([]*fieldAgg, len(opts.Fields))}
+			for i := range g.fields {
+				g.fields[i] = &fieldAgg{}
+			}
+			groups[name] = g
+		}
+		g.bucket.Count++
+		for i, field := range opts.Fields {
+			if v, ok := fieldNumber(doc, field); ok {
+				g.fields[i].add(v, sampleCap, rnd)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	var buckets = make([]AggBucket, 0, len(groups))
+	for _, g := range groups {
+		var b = g.bucket
+		if len(g.fields) > 0 {
+			b.Stats = make([]FieldStats, len(g.fields))
+			for i, f := range g.fields {
+				b.Stats[i] = f.stats(opts.Percentiles)
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Time != buckets[j].Time {
+			return buckets[i].Time < buckets[j].Time
+		}
+		for k := range buckets[i].Group {
+			if buckets[i].Group[k] != buckets[j].Group[k] {
+				return buckets[i].Group[k] < buckets[j].Group[k]
+			}
+		}
+		return false
+	})
+	return buckets, nil
+}
+
+// add limit 为保留的样本数, 0不保留
+func (f *fieldAgg) add(v float64, limit int, rnd *rand.Rand) {
+	f.count++
+	if f.count == 1 || v < f.min {
+		f.min = v
+	}
+	if f.count == 1 || v > f.max {
+		f.max = v
+	}
+	f.sum += v
+	if len(f.samples) < limit {
+		f.samples = append(f.samples, v)
+	} else if j := rnd.Int63n(f.count); j < int64(limit) {
+		f.samples[j] = v
+	}
+}
+
+// shrink 随机保留n个样本, 均匀抽样的子集仍然是均匀抽样, 之后可以继续蓄水池抽样
+func (f *fieldAgg) shrink(n int, rnd *rand.Rand) {
+	if len(f.samples) <= n {
+		return
+	}
+	rnd.Shuffle(len(f.samples), func(i, j int) { f.samples[i], f.samples[j] = f.samples[j], f.samples[i] })
+	f.samples = append([]float64(nil), f.samples[:n]...)
+}
+
+func (f *fieldAgg) stats(percentiles []float64) FieldStats {
+	var s = FieldStats{Count: f.count, Min: f.min, Max: f.max}
+	if f.count == 0 {
+		return s
+	}
+	s.Avg = f.sum / float64(f.count)
+	if len(percentiles) == 0 || len(f.samples) == 0 {
+		return s
+	}
+	sort.Float64s(f.samples)
+	s.Percentiles = make([]float64, len(percentiles))
+	for i, p := range percentiles {
+		// 最近秩
+		var rank = int(math.Ceil(p/100*float64(len(f.samples)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		s.Percentiles[i] = f.samples[rank]
+	}
+	return s
+}
+
+// fieldNumber 数值字段的值, 不是数字时返回false
+func fieldNumber(doc bsoncore.Document, path string) (float64, bool) {
+	v, err := doc.LookupErr(strings.Split(path, ".")...)
+	if err != nil || !isNumber(v) {
+		return 0, false
+	}
+	if v.Type == bsontype.Double && math.IsNaN(v.Double()) {
+		return 0, false
+	}
+	return asFloat(v), true
+}
@@ -0,0 +1,168 @@
+package kv
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	bytesutils "logkv/bytes-utils"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Compression 块的压缩方式, 记录在每个块的第一个字节
+// 块解压后是连续的bson文档, 索引记录块在段内的偏移和文档在块内的偏移
+type Compression byte
+
+const (
+	CompressNone Compression = iota
+	CompressSnappy
+	CompressZstd
+)
+
+var (
+	ErrUnknownCompression = errors.New("unknown compression")
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "none", "":
+		return CompressNone, nil
+	case "snappy":
+		return CompressSnappy, nil
+	case "zstd":
+		return CompressZstd, nil
+	}
+	return CompressNone, fmt.Errorf("unknown compression %q", s)
+}
+
+// encodeBlock 把多个文档压缩成一个块
+func encodeBlock(c Compression, body []byte) ([]byte, error) {
+	var payload = []byte{byte(c)}
+	switch c {
+	case CompressNone:
+		payload = append(payload, body...)
+	case CompressSnappy:
+		payload = append(payload, snappy.Encode(nil, body)...)
+	case CompressZstd:
+		payload = zstdEncoder.EncodeAll(body, payload)
+	default:
+		return nil, ErrUnknownCompression
+	}
+	return payload, nil
+}
+
+// decodeBlock 解压一个块, 返回连续的bson文档
+func decodeBlock(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, ErrCorrupt
+	}
+	switch Compression(payload[0]) {
+	case CompressNone:
+		return payload[1:], nil
+	case CompressSnappy:
+		return snappy.Decode(nil, payload[1:])
+	case CompressZstd:
+		return zstdDecoder.DecodeAll(payload[1:], nil)
+	}
+	return nil, ErrUnknownCompression
+}
+
+// blockDoc 读取块内偏移处的文档
+func blockDoc(body []byte, offset int32) (bsoncore.Document, error) {
+	if offset < 0 || int(offset)+4 > len(body) {
+		return nil, ErrCorrupt
+	}
+	size, _ := bytesutils.BytesToIntU(body[offset : offset+4])
+	if int(offset)+int(size) > len(body) {
+		return nil, ErrCorrupt
+	}
+	return bsoncore.Document(body[offset : int(offset)+int(size)]), nil
+}
+
+// eachBlockDoc 依次遍历块内的文档
+func eachBlockDoc(body []byte, fn func(offset int32, doc bsoncore.Document) bool) error {
+	var offset int32
+	for int(offset) < len(body) {
+		doc, err := blockDoc(body, offset)
+		if err != nil {
+			return err
+		}
+		if !fn(offset, doc) {
+			return nil
+		}
+		offset += int32(len(doc))
+	}
+	return nil
+}
+
+type blockKey struct {
+	segment int64
+	offset  int64
+}
+
+// blockCache 最近读取过的解压后的块, 减少随机读时重复解压
+type blockCache struct {
+	sync.Mutex
+	cap int
+	ll  *list.List
+	m   map[blockKey]*list.Element
+}
+
+type blockCacheEntry struct {
+	key  blockKey
+	body []byte
+}
+
+func newBlockCache(cap int) *blockCache {
+	return &blockCache{
+		cap: cap,
+		ll:  list.New(),
+		m:   make(map[blockKey]*list.Element, cap),
+	}
+}
+
+func (c *blockCache) Get(key blockKey) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.m[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*blockCacheEntry).body, true
+	}
+	return nil, false
+}
+
+func (c *blockCache) Set(key blockKey, body []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.m[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*blockCacheEntry).body = body
+		return
+	}
+	c.m[key] = c.ll.PushFront(&blockCacheEntry{key: key, body: body})
+	for c.ll.Len() > c.cap {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.m, el.Value.(*blockCacheEntry).key)
+	}
+}
+
+// DelSegment 段被删除后清掉它的块
+func (c *blockCache) DelSegment(segment int64) {
+	c.Lock()
+	defer c.Unlock()
+	for key, el := range c.m {
+		if key.segment == segment {
+			c.ll.Remove(el)
+			delete(c.m, key)
+		}
+	}
+}
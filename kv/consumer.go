@@ -0,0 +1,133 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 消费者提交的位置保存在数据目录下的这个文件里
+const consumerFile = "consumers.json"
+
+var (
+	ErrInvalidConsumer = errors.New("invalid consumer name")
+	ErrNoConsumer      = errors.New("consumer not found")
+)
+
+// consumers 每个消费者下一次要读的位置, 每次提交都整个重写文件
+type consumers struct {
+	sync.Mutex
+	path    string
+	offsets map[string]Position
+}
+
+func loadConsumers(dirname string) (*consumers, error) {
+	var c = &consumers{
+		path:    filepath.Join(dirname, consumerFile),
+		offsets: make(map[string]Position),
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.offsets); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *consumers) get(name string) (Position, bool) {
+	c.Lock()
+	defer c.Unlock()
+	pos, ok := c.offsets[name]
+	return pos, ok
+}
+
+// add 消费者不存在时以pos注册, 返回当前的位置
+func (c *consumers) add(name string, pos Position) (Position, error) {
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.offsets[name]; ok {
+		return old, nil
+	}
+	c.offsets[name] = pos
+	if err := c.save(); err != nil {
+		delete(c.offsets, name)
+		return pos, err
+	}
+	return pos, nil
+}
+
+func (c *consumers) set(name string, pos Position) error {
+	c.Lock()
+	defer c.Unlock()
+	old, ok := c.offsets[name]
+	c.offsets[name] = pos
+	if err := c.save(); err != nil {
+		if ok {
+			c.offsets[name] = old
+		} else {
+			delete(c.offsets, name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *consumers) del(name string) error {
+	c.Lock()
+	defer c.Unlock()
+	old, ok := c.offsets[name]
+	if !ok {
+		return ErrNoConsumer
+	}
+	delete(c.offsets, name)
+	if err := c.save(); err != nil {
+		c.offsets[name] = old
+		return err
+	}
+	return nil
+}
+
+func (c *consumers) all() map[string]Position {
+	c.Lock()
+	defer c.Unlock()
+	var offsets = make(map[string]Position, len(c.offsets))
+	for name, pos := range c.offsets {
+		offsets[name] = pos
+	}
+	return offsets
+}
+
+// minSegment 所有消费者还要读的最老的段, 没有消费者时返回false
+func (c *consumers) minSegment() (int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	var min int64
+	var ok bool
+	for _, pos := range c.offsets {
+		if !ok || pos.Segment < min {
+			min, ok = pos.Segment, true
+		}
+	}
+	return min, ok
+}
+
+// save 先写临时文件再改名, 需要持有 c.Lock
+func (c *consumers) save() error {
+	data, err := json.MarshalIndent(c.offsets, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,146 @@
+package kv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// 校验和正确但是解密失败, 说明密钥不对, 不能当成损坏的数据截掉
+	ErrDecrypt = errors.New("decrypt failed, wrong encryption key")
+)
+
+// Keyring 数据加密用的密钥, 每个密钥有一个编号
+// 新文件用编号最大的密钥加密, 文件头里记录密钥编号, 换密钥不用重写旧文件
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// LoadKeyring 解析 "编号:十六进制密钥" 的列表, 用逗号或者换行分隔
+// 密钥长度为16/24/32字节, 对应 AES-128/192/256
+func LoadKeyring(spec string) (*Keyring, error) {
+	var k = &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	for _, item := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+		var kv = strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid key %q, want id:hex", item)
+		}
+		id, err := strconv.ParseUint(kv[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid key id %q", kv[0])
+		}
+		secret, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", id, err)
+		}
+		block, err := aes.NewCipher(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[uint32(id)] = aead
+		if uint32(id) > k.active {
+			k.active = uint32(id)
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil, errors.New("no encryption key")
+	}
+	return k, nil
+}
+
+func LoadKeyringFile(name string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return LoadKeyring(string(data))
+}
+
+// sealer 按密钥编号取出加解密器, 编号0表示不加密
+func (k *Keyring) sealer(id uint32) (*sealer, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	return &sealer{id: id, aead: aead}, nil
+}
+
+// activeID 新文件使用的密钥编号
+func (k *Keyring) activeID() uint32 {
+	if k == nil {
+		return 0
+	}
+	return k.active
+}
+
+// sealer 用 AES-GCM 加密一段数据, 随机nonce放在密文前面
+// nil 表示不加密, 原样返回
+type sealer struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
+func (s *sealer) keyID() uint32 {
+	if s == nil {
+		return 0
+	}
+	return s.id
+}
+
+// overhead 加密后比明文多出的字节数
+func (s *sealer) overhead() int {
+	if s == nil {
+		return 0
+	}
+	return s.aead.NonceSize() + s.aead.Overhead()
+}
+
+func (s *sealer) seal(plain []byte) []byte {
+	if s == nil {
+		return plain
+	}
+	var nonce = make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+	return s.aead.Seal(nonce, nonce, plain, nil)
+}
+
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	if s == nil {
+		return sealed, nil
+	}
+	var n = s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrDecrypt
+	}
+	plain, err := s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
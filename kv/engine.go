@@ -1,86 +1,483 @@
 package kv
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"log"
 	"logkv/skipmap"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 type EngineMeta struct {
-	filename string
+	dirname string
+
+	// 单个段文件的大小上限, 超过后滚动到新段
+	segmentSize int64
+	// 按时间边界滚动, 例如每天一个段
+	rollInterval time.Duration
+
+	// 预写日志的落盘策略
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+
+	// 保留策略, 超过时间或者总大小超过上限的旧段在后台删除
+	retentionAge  time.Duration
+	retentionSize int64
+
+	// 块压缩, 块大小为压缩前的大小
+	compression Compression
+	blockSize   int
+
+	// 加密用的密钥, 为空不加密
+	keys *Keyring
+
+	// 缓存的内存上限, 达到四分之一时触发刷盘, 达到上限时拒绝写入
+	memLimit int64
+
+	// 链路id字段, 为空不建链路索引
+	traceKey string
+	// 建二级索引的字段
+	indexes []string
+	// 建全文索引的字段
+	textFields []string
+
+	// 缓存里有数据时最长多久刷一次盘, 变更流只能读到刷盘后的数据, 0只按大小刷盘
+	flushInterval time.Duration
+	// 保留策略是否保留消费者还没读的段
+	consumerRetention bool
+}
+
+type Option func(meta *EngineMeta)
+
+func WithSegmentSize(size int64) Option {
+	return func(meta *EngineMeta) {
+		meta.segmentSize = size
+	}
+}
+
+func WithRollInterval(d time.Duration) Option {
+	return func(meta *EngineMeta) {
+		meta.rollInterval = d
+	}
+}
+
+func WithSyncPolicy(policy SyncPolicy, interval time.Duration) Option {
+	return func(meta *EngineMeta) {
+		meta.syncPolicy = policy
+		meta.syncInterval = interval
+	}
+}
+
+func WithRetention(age time.Duration, size int64) Option {
+	return func(meta *EngineMeta) {
+		meta.retentionAge = age
+		meta.retentionSize = size
+	}
+}
+
+func WithCompression(c Compression, blockSize int) Option {
+	return func(meta *EngineMeta) {
+		meta.compression = c
+		if blockSize > maxBlockSize {
+			log.Printf("block size %d exceeds %d, clamped", blockSize, maxBlockSize)
+			blockSize = maxBlockSize
+		}
+		if blockSize > 0 {
+			meta.blockSize = blockSize
+		}
+	}
+}
+
+func WithKeyring(keys *Keyring) Option {
+	return func(meta *EngineMeta) {
+		meta.keys = keys
+	}
+}
+
+func WithMemLimit(limit int64) Option {
+	return func(meta *EngineMeta) {
+		meta.memLimit = limit
+	}
+}
+
+// WithTraceKey 按这个字段建立链路索引, 嵌套字段用点分隔
+// 索引随段的索引文件保存, 换字段后启动时会重建索引文件
+func WithTraceKey(key string) Option {
+	return func(meta *EngineMeta) {
+		meta.traceKey = key
+	}
+}
+
+// WithIndexes 给这些字段建二级索引, 嵌套字段用点分隔, 和链路索引一样随段的索引文件保存
+func WithIndexes(fields ...string) Option {
+	return func(meta *EngineMeta) {
+		meta.indexes = append(meta.indexes, fields...)
+	}
+}
+
+// WithTextFields 给这些字符串字段建全文索引, 索引保存在每个段的全文索引文件里
+func WithTextFields(fields ...string) Option {
+	return func(meta *EngineMeta) {
+		meta.textFields = append(meta.textFields, fields...)
+	}
+}
+
+// WithFlushInterval 缓存里有数据时至少每隔d刷一次盘, 让变更流的消费者尽快读到新数据
+func WithFlushInterval(d time.Duration) Option {
+	return func(meta *EngineMeta) {
+		meta.flushInterval = d
+	}
+}
+
+// WithConsumerRetention 为true时保留策略不删除消费者还没读完的段, 默认开启
+func WithConsumerRetention(on bool) Option {
+	return func(meta *EngineMeta) {
+		meta.consumerRetention = on
+	}
 }
 
 type KvEngine struct {
 	sync.Mutex
 	meta    EngineMeta
-	fd      *os.File
 	indexer *KvIndexer
 
+	// 保护 segments, 最后一个段为当前写入的段
+	segLock  sync.RWMutex
+	segments []*segment
+
+	// 同一时间只允许一个flush
+	flushLock sync.Mutex
+
 	traceKey string
+	// 索引文件里保存的字段和对应的索引, 有链路索引时链路字段在第一个
+	fields  []string
+	indexes []*Index
+	// 全文索引, 词 -> key, 没有全文字段时为nil
+	text *Index
+
+	// 启动时恢复的损坏数据
+	recovered []RecoverInfo
 
 	cache *skipmap.Skipmap
+	wal   *wal
+	// 给没有_id的文档分配key
+	ids *idGen
+	// 缓存中数据的字节数
+	memBytes int64
+
+	// 解压后的块
+	blocks *blockCache
 
-	ch chan []byte
+	// 新数据的订阅, 受 e.Lock 保护
+	subs map[*Subscription]struct{}
+
+	// 变更流消费者提交的位置
+	consumers *consumers
+
+	// 关闭 ch 时持有写锁, 写入队列时持有读锁, 关闭之后的写入返回 ErrClosed
+	chLock  sync.RWMutex
+	closed  bool
+	ch      chan *setReq
+	done    chan struct{}
+	flushCh chan struct{}
 }
 
 func (e *KvEngine) Close() {
-	close(e.ch)
-	for len(e.ch) > 0 {
-		time.Sleep(1 * time.Millisecond)
+	e.chLock.Lock()
+	if e.closed {
+		e.chLock.Unlock()
+		return
 	}
+	e.closed = true
+	close(e.ch)
+	e.chLock.Unlock()
+	<-e.done
+	e.closeSubscriptions()
 	if err := e.flush(); err != nil {
 		log.Println(err)
 	}
+	if err := e.wal.close(); err != nil {
+		log.Println(err)
+	}
+	e.segLock.Lock()
+	defer e.segLock.Unlock()
+	for _, seg := range e.segments {
+		if err := seg.close(); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
-func NewKvEngine(ctx context.Context, filename string) *KvEngine {
+func NewKvEngine(ctx context.Context, dirname string, opts ...Option) *KvEngine {
 	e := &KvEngine{
 		meta: EngineMeta{
-			filename: filename,
+			dirname:      dirname,
+			segmentSize:  256 * 1024 * 1024,
+			syncPolicy:   SyncAlways,
+			syncInterval: 10 * time.Millisecond,
+			blockSize:    64 * 1024,
+			memLimit:     256 * 1024 * 1024,
+
+			consumerRetention: true,
 		},
-		indexer: NewKvIndexer(),
 		cache:   skipmap.New(),
-		ch:      make(chan []byte, 1024*1024),
+		ids:     newIDGen(),
+		blocks:  newBlockCache(256),
+		ch:      make(chan *setReq, 64*1024),
+		done:    make(chan struct{}),
+		flushCh: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(&e.meta)
+	}
+	e.traceKey = e.meta.traceKey
+	e.indexer = NewKvIndexer(e.meta.indexes...)
+	if e.traceKey != "" {
+		e.fields = append(e.fields, e.traceKey)
+		e.indexes = append(e.indexes, e.indexer.trace)
+	}
+	for _, field := range e.meta.indexes {
+		e.fields = append(e.fields, field)
+		e.indexes = append(e.indexes, e.indexer.Index(field))
+	}
+	if len(e.meta.textFields) > 0 {
+		e.text = NewIndex()
+	}
+	if err := os.MkdirAll(dirname, os.ModePerm); err != nil {
+		panic(err)
+	}
+	if err := e.openSegments(); err != nil {
+		panic(err)
 	}
-	var err error
-	e.fd, err = os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend|os.ModePerm)
+	consumers, err := loadConsumers(dirname)
 	if err != nil {
 		panic(err)
 	}
-	e.initIndexes()
+	e.consumers = consumers
+	if err := e.initIndexes(); err != nil {
+		panic(err)
+	}
+	if err := e.replayWal(); err != nil {
+		panic(err)
+	}
+	e.ids.seed(e.maxKey(), time.Now())
 	go e.flushTick(ctx)
+	go e.retentionTick(ctx)
 	go e.receive()
 	return e
 }
 
-func (e *KvEngine) initIndexes() {
-	err := ReadIndexes(e.fd, e.traceKey, func(key primitive.ObjectID, trace string, offset int64) {
-		e.indexer.Set(key, offset)
-		if trace != "" {
-			e.indexer.SetTrace(trace, key)
+func (e *KvEngine) openSegments() error {
+	ids, err := listFiles(e.meta.dirname, segmentExt)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		ids = append(ids, 1)
+	}
+	for _, id := range ids {
+		seg, err := openSegment(e.meta.dirname, id, e.meta.keys)
+		if err != nil {
+			return err
 		}
-	})
+		e.segments = append(e.segments, seg)
+	}
+	// 启用加密或者换了密钥, 最后一个段还是旧的密钥, 新数据写到新段
+	if last := e.segments[len(e.segments)-1]; last.sealer.keyID() != e.meta.keys.activeID() {
+		seg, err := openSegment(e.meta.dirname, last.id+1, e.meta.keys)
+		if err != nil {
+			return err
+		}
+		e.segments = append(e.segments, seg)
+	}
+	return nil
+}
+
+func (e *KvEngine) initIndexes() error {
+	for _, seg := range e.segments {
+		if err := e.loadSegmentIndex(seg); err != nil {
+			return err
+		}
+		if !seg.min.IsZero() {
+			seg.created = seg.min.Timestamp()
+		}
+	}
+	return nil
+}
+
+// loadSegmentIndex 先加载索引文件, 再读取索引文件之后的尾部数据
+// 索引文件不存在或者过期时重新扫描整个段
+func (e *KvEngine) loadSegmentIndex(seg *segment) error {
+	var fields = e.indexFields()
+	var name = indexName(e.meta.dirname, seg.id)
+	entries, covered, clean, err := loadIndexFile(name, seg.sealer, fields, seg.size)
 	if err != nil {
-		log.Println(err)
+		if !os.IsNotExist(err) {
+			log.Printf("segment %d: rebuild index: %v", seg.id, err)
+		}
+		entries, covered, clean = nil, fileHeaderSize, false
+	}
+	for _, en := range entries {
+		e.setIndex(seg, en)
+	}
+
+	// 中间损坏的块换成填充块之后从这个位置继续读
+	var tail []indexEntry
+	for from := covered; ; {
+		offset, err := ReadIndexes(io.NewSectionReader(seg.fd, from, seg.size-from), seg.sealer, e.indexValues, func(key primitive.ObjectID, values []string, offset int64, inblock int32) {
+			var en = indexEntry{key: key, offset: from + offset, inblock: inblock, fields: values}
+			e.setIndex(seg, en)
+			tail = append(tail, en)
+		})
+		if err == nil {
+			break
+		}
+		if !isTornRecord(err) {
+			return err
+		}
+		info, err := recoverCorrupt(seg, from+offset)
+		if err != nil {
+			return err
+		}
+		e.recovered = append(e.recovered, info)
+		if info.Tail {
+			break
+		}
+		from += offset
 	}
+	log.Printf("segment %d: load %d indexes, replay %d records", seg.id, len(entries), len(tail))
+
+	err = nil
+	if !clean {
+		err = rewriteIndexFile(name, seg.sealer, fields, append(entries, tail...), seg.size)
+	} else if len(tail) > 0 {
+		err = appendIndexFile(name, seg.sealer, fields, tail, seg.size)
+	}
+	if err != nil {
+		log.Printf("segment %d: write index: %v", seg.id, err)
+	}
+	if e.text != nil {
+		return e.loadTextIndex(seg)
+	}
+	return nil
 }
 
-func (e *KvEngine) rawFileReader() (io.Reader, error) {
-	var reader bytes.Buffer
-	f, err := os.OpenFile(e.meta.filename, os.O_RDONLY, os.ModePerm)
+// loadTextIndex 加载全文索引文件, 再读取文件之后的尾部数据, 文件不存在或者过期时从段文件重建
+// 在 loadSegmentIndex 之后调用, 段文件损坏的尾部已经截断
+func (e *KvEngine) loadTextIndex(seg *segment) error {
+	var name = textName(e.meta.dirname, seg.id)
+	entries, covered, clean, err := loadIndexFile(name, seg.sealer, e.meta.textFields, seg.size)
 	if err != nil {
-		return nil, err
+		if !os.IsNotExist(err) {
+			log.Printf("segment %d: rebuild text index: %v", seg.id, err)
+		}
+		entries, covered, clean = nil, fileHeaderSize, false
+	}
+	for _, en := range entries {
+		e.setText(en)
 	}
-	_, err = io.Copy(&reader, f)
+
+	var tail []indexEntry
+	_, err = ReadIndexes(io.NewSectionReader(seg.fd, covered, seg.size-covered), seg.sealer, e.textValues, func(key primitive.ObjectID, values []string, offset int64, inblock int32) {
+		var en = indexEntry{key: key, offset: covered + offset, inblock: inblock, fields: values}
+		e.setText(en)
+		tail = append(tail, en)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !clean {
+		err = rewriteIndexFile(name, seg.sealer, e.meta.textFields, append(entries, tail...), seg.size)
+	} else if len(tail) > 0 {
+		err = appendIndexFile(name, seg.sealer, e.meta.textFields, tail, seg.size)
+	}
+	if err != nil {
+		log.Printf("segment %d: write text index: %v", seg.id, err)
+	}
+	return nil
+}
+
+func (e *KvEngine) setIndex(seg *segment, en indexEntry) {
+	e.indexer.Set(en.key, Position{Segment: seg.id, Offset: en.offset, InBlock: en.inblock})
+	seg.track(en.key)
+	for j, idx := range e.indexes {
+		if en.fields[j] != "" {
+			idx.Set(en.fields[j], en.key)
+		}
+	}
+}
+
+func (e *KvEngine) setText(en indexEntry) {
+	for _, terms := range en.fields {
+		for _, term := range strings.Fields(terms) {
+			e.text.Set(term, en.key)
+		}
+	}
+}
+
+// textValues 全文索引文件里保存的每个全文字段的词
+func (e *KvEngine) textValues(doc bsoncore.Document) []string {
+	return textTerms(doc, e.meta.textFields)
+}
+
+// indexFields 索引文件里除了key和偏移之外要保存的字段
+func (e *KvEngine) indexFields() []string {
+	return e.fields
+}
+
+func (e *KvEngine) indexValues(doc bsoncore.Document) []string {
+	return fieldValues(doc, e.fields)
+}
+
+// maxKey 已写入的最大key
+func (e *KvEngine) maxKey() primitive.ObjectID {
+	var max primitive.ObjectID
+	e.segLock.RLock()
+	for _, seg := range e.segments {
+		if _, smax := seg.bounds(); compareKey(smax, max) > 0 {
+			max = smax
+		}
+	}
+	e.segLock.RUnlock()
+	e.Lock()
+	if node, ok := e.cache.Last(); ok && compareKey(node.Key(), max) > 0 {
+		max = node.Key()
+	}
+	e.Unlock()
+	return max
+}
+
+// activeSegment 返回当前写入的段, 需要时滚动到新段
+func (e *KvEngine) activeSegment() (*segment, error) {
+	e.segLock.Lock()
+	defer e.segLock.Unlock()
+	active := e.segments[len(e.segments)-1]
+	if !active.shouldRoll(&e.meta, time.Now()) {
+		return active, nil
+	}
+	seg, err := openSegment(e.meta.dirname, active.id+1, e.meta.keys)
 	if err != nil {
 		return nil, err
 	}
-	return &reader, nil
+	e.segments = append(e.segments, seg)
+	return seg, nil
+}
+
+// segment 按编号查找段
+func (e *KvEngine) segment(id int64) *segment {
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	for _, seg := range e.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
 }
@@ -0,0 +1,927 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testEngine 在临时目录里打开的引擎, 可以用同一个目录重新打开
+type testEngine struct {
+	*KvEngine
+	dirname string
+	opts    []Option
+	cancel  context.CancelFunc
+}
+
+// newTestEngine 在新的临时目录里打开引擎, 用完调用 cleanup
+func newTestEngine(t *testing.T, opts ...Option) *testEngine {
+	t.Helper()
+	dirname, err := ioutil.TempDir("", "logkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e = &testEngine{dirname: dirname, opts: opts}
+	e.open()
+	return e
+}
+
+// open 用同一个目录打开引擎, 没有传选项时用上次的选项
+func (e *testEngine) open(opts ...Option) {
+	if len(opts) > 0 {
+		e.opts = opts
+	}
+	var ctx context.Context
+	ctx, e.cancel = context.WithCancel(context.Background())
+	e.KvEngine = NewKvEngine(ctx, e.dirname, e.opts...)
+}
+
+// stop 正常关闭引擎, 目录保留
+func (e *testEngine) stop() {
+	e.Close()
+	e.cancel()
+}
+
+// restart 关闭后重新打开
+func (e *testEngine) restart(opts ...Option) {
+	e.stop()
+	e.open(opts...)
+}
+
+// kill 不关闭引擎直接重新打开, 模拟进程被杀掉
+func (e *testEngine) kill() {
+	e.cancel()
+	e.open()
+}
+
+// cleanup 关闭引擎并删除目录
+func (e *testEngine) cleanup() {
+	e.stop()
+	os.RemoveAll(e.dirname)
+}
+
+// 并发的 Get/Scan/Set/flush, 配合 go test -race 检查读路径
+func TestConcurrentReadWrite(t *testing.T) {
+	var e = newTestEngine(t, WithSegmentSize(16*1024), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+
+	const writers, perWriter = 4, 200
+	var docs sync.Map
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				var id = primitive.NewObjectID()
+				data, err := bson.Marshal(bson.M{"_id": id, "writer": w, "i": i, "msg": "hello logkv"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := e.Set(data); err != nil {
+					t.Error(err)
+					return
+				}
+				docs.Store(id, data)
+				if i%50 == 0 {
+					if err := e.flush(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	var done = make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				docs.Range(func(key, val interface{}) bool {
+					data, err := e.Get(key.(primitive.ObjectID))
+					if err != nil {
+						t.Errorf("get %s: %v", key.(primitive.ObjectID).Hex(), err)
+						return false
+					}
+					if !bytes.Equal(data, val.([]byte)) {
+						t.Errorf("get %s: data mismatch", key.(primitive.ObjectID).Hex())
+						return false
+					}
+					return true
+				})
+				if _, err := e.Scan(primitive.NilObjectID, MaxKey, 100); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	var count = 0
+	docs.Range(func(key, val interface{}) bool {
+		data, err := e.Get(key.(primitive.ObjectID))
+		if err != nil || !bytes.Equal(data, val.([]byte)) {
+			t.Errorf("get %s after flush: %v", key.(primitive.ObjectID).Hex(), err)
+		}
+		count++
+		return true
+	})
+	if count != writers*perWriter {
+		t.Fatalf("expect %d docs, got %d", writers*perWriter, count)
+	}
+}
+
+// 扫描合并缓存和磁盘, 并发flush和覆盖写入时按key顺序(正序或倒序)返回, 不丢不重
+func TestScanDuringFlush(t *testing.T) {
+	var e = newTestEngine(t, WithSegmentSize(64*1024), WithCompression(CompressSnappy, 2048), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+
+	// 倒序写入, 段文件里的顺序和key的顺序相反
+	var keys = make([]primitive.ObjectID, 3000)
+	for i := range keys {
+		keys[i] = primitive.NewObjectID()
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		data, _ := bson.Marshal(bson.M{"_id": keys[i], "i": i})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+		if i%700 == 0 {
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var done = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; ; j++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, _ := bson.Marshal(bson.M{"_id": keys[j%len(keys)], "i": j % len(keys), "v": j})
+			if _, err := e.Set(data); err != nil {
+				t.Error(err)
+				return
+			}
+			if j%500 == 0 {
+				if err := e.flush(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	// 奇数轮倒序
+	for round := 0; round < 20; round++ {
+		var n int
+		var reverse = round%2 == 1
+		var it = e.NewIterator(primitive.NilObjectID, MaxKey, reverse)
+		for it.Next() {
+			if n >= len(keys) {
+				t.Fatalf("round %d: unexpected %s", round, it.Key().Hex())
+			}
+			var expect = keys[n]
+			if reverse {
+				expect = keys[len(keys)-1-n]
+			}
+			if it.Key() != expect {
+				t.Fatalf("round %d: expect %s at %d, got %s", round, expect.Hex(), n, it.Key().Hex())
+			}
+			if DocKey(it.Value()) != it.Key() {
+				t.Fatalf("round %d: value of %s mismatch", round, it.Key().Hex())
+			}
+			n++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if n != len(keys) {
+			t.Fatalf("round %d: expect %d docs, got %d", round, len(keys), n)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// 消费者分页读取变更流, 提交的位置重启后还在, 保留策略不删除消费者没读完的段
+func TestChangesConsumer(t *testing.T) {
+	var e = newTestEngine(t, WithSegmentSize(4*1024), WithCompression(CompressNone, 1024), WithSyncPolicy(SyncNone, 0), WithRetention(0, 1))
+	defer e.cleanup()
+	var keys []primitive.ObjectID
+	for i := 0; i < 300; i++ {
+		data, _ := bson.Marshal(bson.M{"i": i, "msg": "hello logkv"})
+		key, err := e.Set(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if i%100 == 99 {
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var read []primitive.ObjectID
+	var next = func() int {
+		pos, err := e.ConsumerOffset("archiver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes, pos, err := e.Changes(pos, 40, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range changes {
+			read = append(read, c.Key)
+		}
+		if err := e.CommitOffset("archiver", pos); err != nil {
+			t.Fatal(err)
+		}
+		return len(changes)
+	}
+	for len(read) < 120 {
+		next()
+	}
+	e.restart()
+
+	pos, _ := e.ConsumerOffset("archiver")
+	if err := e.enforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if first := e.firstPosition(); first.Segment != pos.Segment {
+		t.Fatalf("retention kept from segment %d, consumer at %d", first.Segment, pos.Segment)
+	}
+	for next() > 0 {
+	}
+	if len(read) != len(keys) {
+		t.Fatalf("read %d changes, want %d", len(read), len(keys))
+	}
+	for i := range keys {
+		if read[i] != keys[i] {
+			t.Fatalf("change %d is %s, want %s", i, read[i].Hex(), keys[i].Hex())
+		}
+	}
+
+	if err := e.RemoveConsumer("archiver"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.enforceRetention(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.Changes(pos, 10, 0); err != ErrOffsetExpired {
+		t.Fatalf("read dropped segment: %v", err)
+	}
+}
+
+// 全文字段去重后的词超过64KB, 重启后从全文索引文件加载, 之后的数据仍然能搜到
+func TestTextIndexRestart(t *testing.T) {
+	var e = newTestEngine(t, WithTextFields("msg"), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	var words = make([]string, 0, 20000)
+	for i := 0; i < cap(words); i++ {
+		words = append(words, fmt.Sprintf("w%d", i))
+	}
+	var docs = []string{strings.Join(words, " "), "after"}
+	for _, msg := range docs {
+		data, _ := bson.Marshal(bson.M{"msg": msg})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for restart := 0; restart < 2; restart++ {
+		e.restart()
+		for _, s := range []string{"w0", "w19999", "after"} {
+			q, err := ParseQuery(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			datas, _, err := e.Search(q, primitive.NilObjectID, MaxKey, ScanOptions{Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(datas) != 1 {
+				t.Fatalf("restart %d: search %q got %d docs, want 1", restart, s, len(datas))
+			}
+		}
+	}
+}
+
+// 全文查询按游标分页, 每页从游标开始查找, 所有结果按key的顺序不丢不重, 只返回key时也一样
+func TestSearchPaging(t *testing.T) {
+	var e = newTestEngine(t, WithTextFields("msg"), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	const docs = 600
+	var keys = make([]primitive.ObjectID, docs)
+	for i := range keys {
+		var words []string
+		if i%2 == 0 {
+			words = append(words, "alpha")
+		}
+		if i%3 == 0 {
+			words = append(words, "beta")
+		}
+		if i%5 == 0 {
+			words = append(words, "connection reset")
+		} else if i%7 == 0 {
+			words = append(words, "reset connection")
+		}
+		keys[i] = primitive.NewObjectID()
+		data, _ := bson.Marshal(bson.M{"_id": keys[i], "msg": strings.Join(words, " ")})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+		// 一半落盘, 一半在缓存里
+		if i == docs/2 {
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var cases = []struct {
+		query string
+		match func(i int) bool
+	}{
+		{"alpha beta", func(i int) bool { return i%6 == 0 }},
+		{"alpha OR beta", func(i int) bool { return i%2 == 0 || i%3 == 0 }},
+		{`"connection reset"`, func(i int) bool { return i%5 == 0 }},
+		{"connection reset", func(i int) bool { return i%5 == 0 || i%7 == 0 }},
+		{"beta OR connection reset", func(i int) bool { return i%3 == 0 || i%5 == 0 || i%7 == 0 }},
+		{"gamma", func(i int) bool { return false }},
+	}
+	for _, c := range cases {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []primitive.ObjectID
+		for i, key := range keys {
+			if c.match(i) {
+				want = append(want, key)
+			}
+		}
+		var got, gotKeys []primitive.ObjectID
+		for start, more := primitive.NilObjectID, true; more; {
+			var datas [][]byte
+			if datas, more, err = e.Search(q, start, MaxKey, ScanOptions{Limit: 7}); err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range datas {
+				got = append(got, DocKey(v))
+			}
+			if more {
+				start, _ = NextKey(got[len(got)-1])
+			}
+		}
+		for start, more := primitive.NilObjectID, true; more; {
+			var page []primitive.ObjectID
+			if page, more, err = e.SearchKeys(q, start, MaxKey, 7); err != nil {
+				t.Fatal(err)
+			}
+			gotKeys = append(gotKeys, page...)
+			if more {
+				start, _ = NextKey(gotKeys[len(gotKeys)-1])
+			}
+		}
+		if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotKeys, want) {
+			t.Fatalf("%q: got %d docs and %d keys, want %d", c.query, len(got), len(gotKeys), len(want))
+		}
+	}
+}
+
+// 关闭时还在写入的协程拿到 ErrClosed, 不会向关闭的队列发送
+func TestSetAfterClose(t *testing.T) {
+	var e = newTestEngine(t, WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, _ := bson.Marshal(bson.M{"msg": "hello logkv"})
+				if _, err := e.Set(data); err == ErrClosed {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	e.Close()
+	wg.Wait()
+	if _, errs := e.BatchSet([][]byte{{5, 0, 0, 0, 0}}); errs[0] != ErrClosed {
+		t.Fatalf("batch set after close: %v", errs[0])
+	}
+}
+
+// 不加密的目录启用加密, 再换新密钥, 每一步的新数据都用当前的密钥写到新段, 之前的数据都能读回来
+func TestEncryptionRotation(t *testing.T) {
+	var e = newTestEngine(t)
+	defer e.cleanup()
+	var stages = []struct {
+		name string
+		keys string
+	}{
+		{"plain", ""},
+		{"key1", "1:000102030405060708090a0b0c0d0e0f"},
+		{"key2", "1:000102030405060708090a0b0c0d0e0f,2:101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"},
+	}
+	var written = make(map[primitive.ObjectID][]byte)
+	for i, stage := range stages {
+		var keys *Keyring
+		if stage.keys != "" {
+			var err error
+			if keys, err = LoadKeyring(stage.keys); err != nil {
+				t.Fatal(err)
+			}
+		}
+		e.restart(WithKeyring(keys), WithCompression(CompressNone, 0), WithSyncPolicy(SyncNone, 0))
+		for j := 0; j < 50; j++ {
+			data, _ := bson.Marshal(bson.M{"_id": primitive.NewObjectID(), "msg": "marker-" + stage.name})
+			key, err := e.Set(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written[key] = data
+		}
+		if err := e.flush(); err != nil {
+			t.Fatal(err)
+		}
+		var active = e.segments[len(e.segments)-1]
+		if active.sealer.keyID() != keys.activeID() {
+			t.Fatalf("%s: active segment key %d, want %d", stage.name, active.sealer.keyID(), keys.activeID())
+		}
+		for key, data := range written {
+			got, err := e.Get(key)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s: get %s: %v", stage.name, key.Hex(), err)
+			}
+		}
+		e.stop()
+
+		// 加密之后段文件里不应该有明文
+		ids, err := listFiles(e.dirname, segmentExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plain bool
+		for _, id := range ids {
+			raw, err := ioutil.ReadFile(segmentName(e.dirname, id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain = plain || bytes.Contains(raw, []byte("marker-"+stage.name))
+		}
+		if plain != (i == 0) {
+			t.Fatalf("%s: plaintext in segments is %v", stage.name, plain)
+		}
+	}
+}
+
+// 二级索引的范围查询, 数字按数值比较, 落盘前后结果相同
+func TestFindRangeNumeric(t *testing.T) {
+	var e = newTestEngine(t, WithIndexes("code", "level", "latency", "ok"), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	for i, latency := range []float64{12.5, 250.5, 900.25} {
+		data, _ := bson.Marshal(bson.M{"latency": latency, "ok": i > 0})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, code := range []int{5, 99, 100, 250, 500, 501, 1000, 4000} {
+		data, _ := bson.Marshal(bson.M{"code": code, "level": "info"})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := bson.Marshal(bson.M{"code": "abc", "level": "warn"})
+	if _, err := e.Set(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		field, min, max string
+		want            int
+	}{
+		{"code", "100", "500", 3},
+		{"code", "1000", "", 3},
+		{"code", "", "99", 2},
+		{"code", "-1", "1e3", 7},
+		{"code", "a", "", 1},
+		{"level", "info", "warn", 9},
+		{"level", "j", "", 1},
+		{"latency", "100", "500", 1},
+		{"latency", "500", "", 1},
+		{"latency", "", "100", 1},
+		{"latency", "250.5", "900.25", 2},
+		{"ok", "true", "true", 2},
+	}
+	for round := 0; round < 2; round++ {
+		for _, c := range cases {
+			datas, _, err := e.FindRange(c.field, c.min, c.max, primitive.NilObjectID, ScanOptions{Limit: 100})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(datas) != c.want {
+				t.Fatalf("round %d: %s in [%q, %q] got %d, want %d", round, c.field, c.min, c.max, len(datas), c.want)
+			}
+		}
+		if datas, _, err := e.Find("latency", "250.5", primitive.NilObjectID, ScanOptions{Limit: 100}); err != nil || len(datas) != 1 {
+			t.Fatalf("round %d: latency = 250.5 got %d: %v", round, len(datas), err)
+		}
+		if err := e.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 倒序写入和覆盖写入之后, 按索引分页读取仍然按key的顺序, 不丢不重
+func TestFindPaging(t *testing.T) {
+	var e = newTestEngine(t, WithIndexes("level"), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	var keys = make([]primitive.ObjectID, 700)
+	for i := range keys {
+		keys[i] = primitive.NewObjectID()
+	}
+	for round := 0; round < 2; round++ {
+		for i := len(keys) - 1; i >= 0; i-- {
+			data, _ := bson.Marshal(bson.M{"_id": keys[i], "level": "info", "round": round})
+			if _, err := e.Set(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := e.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []primitive.ObjectID
+	var start = primitive.NilObjectID
+	for {
+		datas, more, err := e.Find("level", "info", start, ScanOptions{Limit: 300})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range datas {
+			got = append(got, DocKey(data))
+		}
+		if !more {
+			break
+		}
+		start, _ = NextKey(got[len(got)-1])
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("got %d docs, want %d", len(got), len(keys))
+	}
+	for i := range keys {
+		if got[i] != keys[i] {
+			t.Fatalf("doc %d is %s, want %s", i, got[i].Hex(), keys[i].Hex())
+		}
+	}
+}
+
+// 段文件fsync之后, 写检查点之前崩溃, 重放的日志里的数据已经落盘, 不能在变更流里出现两次
+func TestWalReplayAfterFlushCrash(t *testing.T) {
+	var e = newTestEngine(t, WithSyncPolicy(SyncAlways, 0))
+	defer e.cleanup()
+	var key = primitive.NewObjectID()
+	var set = func(data []byte) {
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v1, _ := bson.Marshal(bson.M{"_id": key, "v": 1})
+	v2, _ := bson.Marshal(bson.M{"_id": key, "v": 2})
+	set(v1)
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	set(v2)
+	for i := 0; i < 20; i++ {
+		data, _ := bson.Marshal(bson.M{"_id": primitive.NewObjectID(), "i": i})
+		set(data)
+	}
+	// 落盘之前的日志和检查点, 落盘之后放回去就是写检查点之前崩溃的样子
+	var saved = map[string][]byte{}
+	ids, _ := listFiles(e.dirname, walExt)
+	for _, id := range ids {
+		saved[walName(e.dirname, id)], _ = ioutil.ReadFile(walName(e.dirname, id))
+	}
+	var checkpoint = filepath.Join(e.dirname, walCheckpointFile)
+	saved[checkpoint], _ = ioutil.ReadFile(checkpoint)
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range saved {
+		if err := ioutil.WriteFile(name, data, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.kill()
+
+	if got, err := e.Get(key); err != nil || !bytes.Equal(got, v2) {
+		t.Fatalf("get overwritten key: %v", err)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err := e.Changes(Position{}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// v1 和 v2 各一次, 其他的每个一次
+	var seen = map[primitive.ObjectID]int{}
+	for _, c := range changes {
+		seen[c.Key]++
+	}
+	if len(changes) != 22 || len(seen) != 21 || seen[key] != 2 {
+		t.Fatalf("got %d changes for %d keys, key seen %d times", len(changes), len(seen), seen[key])
+	}
+}
+
+// 不关闭引擎直接重新打开, 模拟进程被杀掉, 每种落盘策略下返回成功的写入都能从预写日志恢复
+// 覆盖写入已经落盘的key也要恢复成新值; 删除旧日志之前崩溃, 留下的旧日志不会覆盖新值
+func TestWalReplayAfterKill(t *testing.T) {
+	var cases = []struct {
+		name   string
+		policy SyncPolicy
+		stale  bool
+	}{
+		{"always", SyncAlways, false},
+		{"interval", SyncInterval, false},
+		{"none", SyncNone, false},
+		{"stale wal", SyncAlways, true},
+	}
+	for _, c := range cases {
+		var e = newTestEngine(t, WithSyncPolicy(c.policy, time.Millisecond))
+		defer e.cleanup()
+		var key = primitive.NewObjectID()
+		var set = func(v int) []byte {
+			data, _ := bson.Marshal(bson.M{"_id": key, "v": v})
+			if _, err := e.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}
+		var stale = map[string][]byte{}
+		set(1)
+		if c.stale {
+			ids, _ := listFiles(e.dirname, walExt)
+			for _, id := range ids {
+				stale[walName(e.dirname, id)], _ = ioutil.ReadFile(walName(e.dirname, id))
+			}
+		}
+		if err := e.flush(); err != nil {
+			t.Fatal(err)
+		}
+		var want = set(2)
+		if c.stale {
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+			for name, data := range stale {
+				if err := ioutil.WriteFile(name, data, os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		var others [][]byte
+		for i := 0; i < 20; i++ {
+			data, _ := bson.Marshal(bson.M{"_id": primitive.NewObjectID(), "i": i})
+			if _, err := e.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			others = append(others, data)
+		}
+		e.kill()
+		if got, err := e.Get(key); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s: overwritten key after replay: %v", c.name, err)
+		}
+		for _, data := range others {
+			if got, err := e.Get(DocKey(data)); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s: get %s after replay: %v", c.name, DocKey(data).Hex(), err)
+			}
+		}
+	}
+}
+
+// 按时间分桶和字段分组统计, 样本没有超过上限时百分位为精确的最近秩
+func TestAggregate(t *testing.T) {
+	var e = newTestEngine(t, WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	// 100秒, 每秒一条, 前60条在第一个分钟桶
+	var base = time.Unix(1700000000-1700000000%60, 0)
+	for i := 0; i < 100; i++ {
+		var key = primitive.NewObjectIDFromTimestamp(base.Add(time.Duration(i) * time.Second))
+		key[11] = byte(i)
+		var app = []string{"a", "b"}[i%2]
+		data, _ := bson.Marshal(bson.M{"_id": key, "app": app, "latency": i + 1})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type bucket struct {
+		time  int64
+		group string
+		count int64
+		min   float64
+		max   float64
+		p50   float64
+	}
+	var cases = []struct {
+		name string
+		opts AggregateOptions
+		want []bucket
+	}{
+		{"total", AggregateOptions{Fields: []string{"latency"}, Percentiles: []float64{50}}, []bucket{
+			{0, "", 100, 1, 100, 50},
+		}},
+		{"minute", AggregateOptions{Interval: time.Minute, Fields: []string{"latency"}, Percentiles: []float64{50}}, []bucket{
+			{base.Unix(), "", 60, 1, 60, 30},
+			{base.Unix() + 60, "", 40, 61, 100, 80},
+		}},
+		{"minute by app", AggregateOptions{Interval: time.Minute, GroupBy: []string{"app"}, Fields: []string{"latency"}, Percentiles: []float64{50}}, []bucket{
+			{base.Unix(), "a", 30, 1, 59, 29},
+			{base.Unix(), "b", 30, 2, 60, 30},
+			{base.Unix() + 60, "a", 20, 61, 99, 79},
+			{base.Unix() + 60, "b", 20, 62, 100, 80},
+		}},
+	}
+	for _, c := range cases {
+		buckets, err := e.Aggregate(primitive.NilObjectID, MaxKey, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != len(c.want) {
+			t.Fatalf("%s: got %d buckets, want %d", c.name, len(buckets), len(c.want))
+		}
+		for i, w := range c.want {
+			var b = buckets[i]
+			var group = strings.Join(b.Group, ",")
+			var s = b.Stats[0]
+			if b.Time != w.time || group != w.group || b.Count != w.count || s.Min != w.min || s.Max != w.max || s.Percentiles[0] != w.p50 {
+				t.Fatalf("%s: bucket %d is %d %q count %d min %v max %v p50 %v, want %+v",
+					c.name, i, b.Time, group, b.Count, s.Min, s.Max, s.Percentiles[0], w)
+			}
+		}
+	}
+
+	// 超过上限的分组数返回错误
+	for i := 0; i <= maxAggGroups; i++ {
+		data, _ := bson.Marshal(bson.M{"i": i})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.Aggregate(primitive.NilObjectID, MaxKey, AggregateOptions{GroupBy: []string{"i"}}); !errors.Is(err, ErrTooManyGroups) {
+		t.Fatalf("too many groups: %v", err)
+	}
+}
+
+// 只能提交块和文档边界上的位置, 错误的位置不会保存, 消费者之后还能正常读取
+func TestCommitOffsetBoundary(t *testing.T) {
+	var e = newTestEngine(t, WithCompression(CompressSnappy, 1024), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	for i := 0; i < 100; i++ {
+		data, _ := bson.Marshal(bson.M{"i": i, "msg": "hello logkv"})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	changes, next, err := e.Changes(Position{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pos = changes[3].Pos
+	var cases = []struct {
+		name string
+		pos  Position
+		ok   bool
+	}{
+		{"next", next, true},
+		{"doc", pos, true},
+		{"head", e.Head(), true},
+		{"mid record", Position{Segment: pos.Segment, Offset: pos.Offset + 1}, false},
+		{"mid doc", Position{Segment: pos.Segment, Offset: pos.Offset, InBlock: pos.InBlock + 1}, false},
+		{"past block", Position{Segment: pos.Segment, Offset: pos.Offset, InBlock: 1 << 20}, false},
+		{"past head", Position{Segment: pos.Segment, Offset: e.Head().Offset + 1}, false},
+	}
+	for _, c := range cases {
+		err := e.CommitOffset("c", c.pos)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: commit %+v: %v", c.name, c.pos, err)
+		}
+		if !c.ok && !errors.Is(err, ErrInvalidOffset) {
+			t.Fatalf("%s: commit %+v: %v", c.name, c.pos, err)
+		}
+		if c.ok {
+			continue
+		}
+		from, err := e.ConsumerOffset("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := e.Changes(from, 10, 0); err != nil {
+			t.Fatalf("%s: read after rejected commit: %v", c.name, err)
+		}
+	}
+}
+
+// 断线续订补发期间覆盖写入补发范围内的key, 新值只推送一次
+func TestSubscribeResumeOverwrite(t *testing.T) {
+	var e = newTestEngine(t, WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+	var keys []primitive.ObjectID
+	for i := 0; i < 600; i++ {
+		data, _ := bson.Marshal(bson.M{"i": i})
+		key, err := e.Set(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if i == 299 {
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sub, err := e.Subscribe(SubscribeOptions{Resume: keys[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	var seen = make(map[primitive.ObjectID]int)
+	var next = func() {
+		if !sub.Next() {
+			t.Fatal(sub.Err())
+		}
+		seen[sub.Key()]++
+	}
+	// 一个在已经读过的范围, 一个在磁盘上, 一个在缓存里
+	next()
+	var overwrite = []primitive.ObjectID{keys[1], keys[200], keys[500]}
+	for _, key := range overwrite {
+		data, _ := bson.Marshal(bson.M{"_id": key, "v": 2})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(seen) < len(keys)-1 || sub.Ready() {
+		next()
+	}
+	for _, key := range keys[1:] {
+		var want = 1
+		if key == keys[1] {
+			want = 2
+		}
+		if seen[key] != want {
+			t.Fatalf("%s delivered %d times, want %d", key.Hex(), seen[key], want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package kv
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// fieldValue 取出文档中某个字段的值用于索引, 嵌套字段用点分隔, 例如 "ctx.trace_id"
+// 字符串取原值, ObjectID 取十六进制, 数字取十进制, 布尔取 true/false, 其他类型用扩展json表示
+// 整数值的浮点数和整数相同, 750.0 和 750 都是 "750"
+// 字段不存在或者为null时返回空字符串, 不建索引
+func fieldValue(doc bsoncore.Document, path string) string {
+	v, err := doc.LookupErr(strings.Split(path, ".")...)
+	if err != nil {
+		return ""
+	}
+	switch v.Type {
+	case bsontype.String:
+		return v.StringValue()
+	case bsontype.ObjectID:
+		return v.ObjectID().Hex()
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(v.Int32()), 10)
+	case bsontype.Int64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case bsontype.Double:
+		return strconv.FormatFloat(v.Double(), 'g', -1, 64)
+	case bsontype.Decimal128:
+		return v.Decimal128().String()
+	case bsontype.Boolean:
+		return strconv.FormatBool(v.Boolean())
+	case bsontype.Null, bsontype.Undefined:
+		return ""
+	}
+	return v.String()
+}
+
+// fieldValues 按顺序取出多个字段的值, 没有字段时返回nil
+func fieldValues(doc bsoncore.Document, paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	var values = make([]string, len(paths))
+	for i, path := range paths {
+		values[i] = fieldValue(doc, path)
+	}
+	return values
+}
+
+// compareIndexValue 索引值的顺序, 用于范围查询
+// 数字按数值比较, 排在字符串前面, 其他按字符串比较, 所以 "1000" 不在 [100, 500] 内
+func compareIndexValue(a, b string) int {
+	fa, na := numberValue(a)
+	fb, nb := numberValue(b)
+	switch {
+	case na && nb:
+		// 整数直接比较, 超过2^53的整数转成浮点数会丢精度
+		ia, erra := strconv.ParseInt(a, 10, 64)
+		ib, errb := strconv.ParseInt(b, 10, 64)
+		if erra == nil && errb == nil {
+			return compareInt(ia, ib)
+		}
+		return compareFloat(fa, fb)
+	case na:
+		return -1
+	case nb:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func numberValue(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
@@ -0,0 +1,311 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter 扫描时逐条检查的过滤条件, 和mongo的查询文档写法相同, 例如
+// {"level": {"$in": ["error", "warn"]}, "latency_ms": {"$gt": 500}, "app": "checkout"}
+// 支持 $eq $ne $gt $gte $lt $lte $in $nin $exists $and $or, 嵌套字段用点分隔
+// 字段为数组时任意一个元素满足即可, 数字不区分int32, int64和double
+type Filter struct {
+	data  []byte
+	match matcher
+}
+
+type matcher func(doc bsoncore.Document) bool
+
+// ParseFilter 解析bson格式的过滤条件
+func ParseFilter(data []byte) (*Filter, error) {
+	var doc = bsoncore.Document(data)
+	if err := doc.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	m, err := compileDoc(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	return &Filter{data: data, match: m}, nil
+}
+
+// Match 文档是否满足条件
+func (f *Filter) Match(doc []byte) bool {
+	return f.match(doc)
+}
+
+// Bytes 过滤条件的bson
+func (f *Filter) Bytes() []byte {
+	return f.data
+}
+
+func compileDoc(doc bsoncore.Document) (matcher, error) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	var ms = make([]matcher, 0, len(elems))
+	for _, el := range elems {
+		var m matcher
+		switch key := el.Key(); key {
+		case "$and", "$or":
+			m, err = compileLogic(key, el.Value())
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("unknown operator %s", key)
+			}
+			m, err = compileField(strings.Split(key, "."), el.Value())
+		}
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return all(ms), nil
+}
+
+// compileLogic $and 和 $or 的值为条件文档的数组
+func compileLogic(op string, v bsoncore.Value) (matcher, error) {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("%s needs an array", op)
+	}
+	vals, err := arr.Values()
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, fmt.Errorf("%s needs a nonempty array", op)
+	}
+	var ms = make([]matcher, 0, len(vals))
+	for _, val := range vals {
+		doc, ok := val.DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("%s needs an array of documents", op)
+		}
+		m, err := compileDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	if op == "$and" {
+		return all(ms), nil
+	}
+	return func(doc bsoncore.Document) bool {
+		for _, m := range ms {
+			if m(doc) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// compileField 值为操作符文档时逐个检查, 否则为相等
+func compileField(path []string, v bsoncore.Value) (matcher, error) {
+	doc, ok := v.DocumentOK()
+	if !ok || !isOperators(doc) {
+		return compileOp(path, "$eq", v)
+	}
+	elems, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+	var ms = make([]matcher, 0, len(elems))
+	for _, el := range elems {
+		m, err := compileOp(path, el.Key(), el.Value())
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return all(ms), nil
+}
+
+func isOperators(doc bsoncore.Document) bool {
+	el, err := doc.IndexErr(0)
+	return err == nil && strings.HasPrefix(el.Key(), "$")
+}
+
+func compileOp(path []string, op string, target bsoncore.Value) (matcher, error) {
+	switch op {
+	case "$eq":
+		return func(doc bsoncore.Document) bool {
+			return fieldEq(doc, path, target)
+		}, nil
+	case "$ne":
+		return func(doc bsoncore.Document) bool {
+			return !fieldEq(doc, path, target)
+		}, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		var ok = map[string]func(c int) bool{
+			"$gt":  func(c int) bool { return c > 0 },
+			"$gte": func(c int) bool { return c >= 0 },
+			"$lt":  func(c int) bool { return c < 0 },
+			"$lte": func(c int) bool { return c <= 0 },
+		}[op]
+		return func(doc bsoncore.Document) bool {
+			v, err := doc.LookupErr(path...)
+			return err == nil && anyValue(v, func(v bsoncore.Value) bool {
+				c, comparable := compareValue(v, target)
+				return comparable && ok(c)
+			})
+		}, nil
+	case "$in", "$nin":
+		arr, ok := target.ArrayOK()
+		if !ok {
+			return nil, fmt.Errorf("%s needs an array", op)
+		}
+		targets, err := arr.Values()
+		if err != nil {
+			return nil, err
+		}
+		var in = func(doc bsoncore.Document) bool {
+			for _, t := range targets {
+				if fieldEq(doc, path, t) {
+					return true
+				}
+			}
+			return false
+		}
+		if op == "$in" {
+			return in, nil
+		}
+		return func(doc bsoncore.Document) bool { return !in(doc) }, nil
+	case "$exists":
+		var want = truthy(target)
+		return func(doc bsoncore.Document) bool {
+			_, err := doc.LookupErr(path...)
+			return (err == nil) == want
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func all(ms []matcher) matcher {
+	return func(doc bsoncore.Document) bool {
+		for _, m := range ms {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// fieldEq 字段不存在时等于null
+func fieldEq(doc bsoncore.Document, path []string, target bsoncore.Value) bool {
+	v, err := doc.LookupErr(path...)
+	if err != nil {
+		return target.Type == bsontype.Null
+	}
+	return equalValue(v, target) || anyValue(v, func(v bsoncore.Value) bool { return equalValue(v, target) })
+}
+
+// anyValue 数组时检查每个元素, 否则检查值本身
+func anyValue(v bsoncore.Value, fn func(v bsoncore.Value) bool) bool {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return fn(v)
+	}
+	vals, err := arr.Values()
+	if err != nil {
+		return false
+	}
+	for _, v := range vals {
+		if fn(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalValue(a, b bsoncore.Value) bool {
+	if c, ok := compareValue(a, b); ok {
+		return c == 0
+	}
+	return a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+}
+
+// compareValue 同类的值才能比较大小, 数字之间可以比较
+func compareValue(a, b bsoncore.Value) (int, bool) {
+	if isNumber(a) && isNumber(b) {
+		if a.Type != bsontype.Double && b.Type != bsontype.Double {
+			return compareInt(a.AsInt64(), b.AsInt64()), true
+		}
+		return compareFloat(asFloat(a), asFloat(b)), true
+	}
+	if a.Type != b.Type {
+		return 0, false
+	}
+	switch a.Type {
+	case bsontype.String:
+		return strings.Compare(a.StringValue(), b.StringValue()), true
+	case bsontype.ObjectID:
+		return compareKey(a.ObjectID(), b.ObjectID()), true
+	case bsontype.DateTime:
+		return compareInt(a.DateTime(), b.DateTime()), true
+	case bsontype.Boolean:
+		return compareInt(boolInt(a.Boolean()), boolInt(b.Boolean())), true
+	case bsontype.Null:
+		return 0, true
+	}
+	return 0, false
+}
+
+func isNumber(v bsoncore.Value) bool {
+	return v.Type == bsontype.Int32 || v.Type == bsontype.Int64 || v.Type == bsontype.Double
+}
+
+// asFloat 当前驱动的 AsFloat64 没有实现, 自己转换
+func asFloat(v bsoncore.Value) float64 {
+	if v.Type == bsontype.Double {
+		return v.Double()
+	}
+	return float64(v.AsInt64())
+}
+
+func truthy(v bsoncore.Value) bool {
+	if v.Type == bsontype.Boolean {
+		return v.Boolean()
+	}
+	if isNumber(v) {
+		return asFloat(v) != 0
+	}
+	return v.Type != bsontype.Null
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
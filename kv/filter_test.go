@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 每个操作符对同一个文档的结果, 以及解析失败的条件
+func TestParseFilter(t *testing.T) {
+	var id = primitive.NewObjectID()
+	var at = time.Unix(1700000000, 0)
+	doc, _ := bson.Marshal(bson.M{
+		"_id":        id,
+		"app":        "checkout",
+		"level":      "error",
+		"latency_ms": int32(750),
+		"size":       int64(1 << 40),
+		"ratio":      0.25,
+		"ok":         false,
+		"at":         at,
+		"tags":       bson.A{"db", "slow"},
+		"ctx":        bson.M{"user": "u1", "retry": 2},
+		"none":       nil,
+	})
+	var cases = []struct {
+		name   string
+		filter interface{}
+		match  bool
+	}{
+		{"eq", bson.M{"app": "checkout"}, true},
+		{"eq op", bson.M{"app": bson.M{"$eq": "orders"}}, false},
+		{"eq int double", bson.M{"latency_ms": 750.0}, true},
+		{"eq objectid", bson.M{"_id": id}, true},
+		{"eq missing null", bson.M{"missing": nil}, true},
+		{"eq null", bson.M{"none": nil}, true},
+		{"eq array element", bson.M{"tags": "slow"}, true},
+		{"eq nested", bson.M{"ctx.user": "u1"}, true},
+		{"ne", bson.M{"level": bson.M{"$ne": "info"}}, true},
+		{"ne array element", bson.M{"tags": bson.M{"$ne": "db"}}, false},
+		{"gt", bson.M{"latency_ms": bson.M{"$gt": 500}}, true},
+		{"gt equal", bson.M{"latency_ms": bson.M{"$gt": 750}}, false},
+		{"gte", bson.M{"latency_ms": bson.M{"$gte": 750}}, true},
+		{"lt double", bson.M{"ratio": bson.M{"$lt": 0.5}}, true},
+		{"lte int64", bson.M{"size": bson.M{"$lte": int64(1<<40 - 1)}}, false},
+		{"range", bson.M{"latency_ms": bson.M{"$gte": 500, "$lt": 1000}}, true},
+		{"gt string", bson.M{"app": bson.M{"$gt": "b"}}, true},
+		{"gt date", bson.M{"at": bson.M{"$gt": at.Add(-time.Second)}}, true},
+		{"gt mixed types", bson.M{"app": bson.M{"$gt": 1}}, false},
+		{"gt missing", bson.M{"missing": bson.M{"$gt": 1}}, false},
+		{"in", bson.M{"level": bson.M{"$in": bson.A{"error", "warn"}}}, true},
+		{"in array", bson.M{"tags": bson.M{"$in": bson.A{"cache", "db"}}}, true},
+		{"nin", bson.M{"level": bson.M{"$nin": bson.A{"error", "warn"}}}, false},
+		{"exists", bson.M{"ctx.retry": bson.M{"$exists": true}}, true},
+		{"not exists", bson.M{"missing": bson.M{"$exists": false}}, true},
+		{"exists number", bson.M{"app": bson.M{"$exists": 0}}, false},
+		{"and", bson.M{"$and": bson.A{bson.M{"app": "checkout"}, bson.M{"ok": true}}}, false},
+		{"or", bson.M{"$or": bson.A{bson.M{"app": "orders"}, bson.M{"ok": false}}}, true},
+		{"implicit and", bson.M{"app": "checkout", "level": "info"}, false},
+		{"nested or", bson.M{"app": "checkout", "$or": bson.A{bson.M{"ctx.retry": bson.M{"$gte": 3}}, bson.M{"tags": "slow"}}}, true},
+		{"empty", bson.M{}, true},
+	}
+	for _, c := range cases {
+		data, err := bson.Marshal(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ParseFilter(data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if f.Match(doc) != c.match {
+			t.Fatalf("%s: match %v, want %v", c.name, !c.match, c.match)
+		}
+	}
+
+	var invalid = []interface{}{
+		bson.M{"$nor": bson.A{bson.M{"a": 1}}},
+		bson.M{"a": bson.M{"$regex": "x"}},
+		bson.M{"a": bson.M{"$in": "x"}},
+		bson.M{"$and": bson.M{"a": 1}},
+		bson.M{"$or": bson.A{}},
+		bson.M{"$or": bson.A{"a"}},
+	}
+	for _, filter := range invalid {
+		data, _ := bson.Marshal(filter)
+		if _, err := ParseFilter(data); !errors.Is(err, ErrInvalidFilter) {
+			t.Fatalf("%v: expect ErrInvalidFilter, got %v", filter, err)
+		}
+	}
+	if _, err := ParseFilter([]byte{1, 2, 3}); !errors.Is(err, ErrInvalidFilter) {
+		t.Fatalf("broken bson: %v", err)
+	}
+}
@@ -3,23 +3,35 @@ package kv
 import (
 	"context"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 func (e *KvEngine) flushTick(ctx context.Context) {
 	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last = time.Now()
 	for {
 		select {
-		case <-ticker.C:
+		case now := <-ticker.C:
 			e.Lock()
-			if e.cache.Len() > 1024*10 {
+			var n = e.cache.Len()
+			e.Unlock()
+			var due = e.meta.flushInterval > 0 && n > 0 && now.Sub(last) >= e.meta.flushInterval
+			if due || n > 1024*10 || atomic.LoadInt64(&e.memBytes) >= e.meta.memLimit/4 {
 				if err := e.flush(); err != nil {
 					log.Println(err)
 				}
+				last = now
 			}
-			e.Unlock()
+		case <-e.flushCh:
+			if err := e.flush(); err != nil {
+				log.Println(err)
+			}
+			last = time.Now()
 		case <-ctx.Done():
 			return
 		}
@@ -27,6 +39,9 @@ func (e *KvEngine) flushTick(ctx context.Context) {
 }
 
 func (e *KvEngine) flush() error {
+	e.flushLock.Lock()
+	defer e.flushLock.Unlock()
+
 	// 将缓存的kv拷贝一份 然后写入磁盘
 	e.Lock()
 	var keys = make([]primitive.ObjectID, 0, e.cache.Len())
@@ -37,24 +52,114 @@ func (e *KvEngine) flush() error {
 		keys = append(keys, node.Key())
 		bucket = append(bucket, node.Val().([]byte))
 	}
+	if len(keys) == 0 {
+		e.Unlock()
+		return nil
+	}
+	// 之后的写入进新的预写日志, 旧的在数据落盘后删除
+	err := e.rotateWal()
+	var walID = e.wal.id
 	e.Unlock()
+	if err != nil {
+		return err
+	}
 
-	offset, err := e.fd.Seek(0, 2)
+	seg, err := e.activeSegment()
 	if err != nil {
 		return err
 	}
-	for i, data := range bucket {
-		n, err := e.fd.Write(data)
+	var entries, texts []indexEntry
+	for start := 0; start < len(bucket); {
+		if seg.shouldRoll(&e.meta, time.Now()) {
+			if err := e.checkpoint(seg, entries, texts); err != nil {
+				return err
+			}
+			entries, texts = nil, nil
+			if seg, err = e.activeSegment(); err != nil {
+				return err
+			}
+		}
+		// 按块大小把连续的文档合成一个块
+		var end = start
+		var body []byte
+		for end < len(bucket) && (end == start || len(body)+len(bucket[end]) <= e.meta.blockSize) {
+			body = append(body, bucket[end]...)
+			end++
+		}
+		payload, err := encodeBlock(e.meta.compression, body)
+		if err != nil {
+			return err
+		}
+		offset, err := seg.append(keys[start:end], payload)
 		if err != nil {
 			return err
 		}
-		e.indexer.Set(keys[i], offset)
-		offset += int64(n)
+		var inblock int32
+		for i := start; i < end; i++ {
+			e.indexer.Set(keys[i], Position{Segment: seg.id, Offset: offset, InBlock: inblock})
+			entries = append(entries, indexEntry{
+				key:     keys[i],
+				offset:  offset,
+				inblock: inblock,
+				fields:  e.indexValues(bsoncore.Document(bucket[i])),
+			})
+			if e.text != nil {
+				texts = append(texts, indexEntry{
+					key:     keys[i],
+					offset:  offset,
+					inblock: inblock,
+					fields:  e.textValues(bsoncore.Document(bucket[i])),
+				})
+			}
+			inblock += int32(len(bucket[i]))
+		}
+		start = end
+	}
+	if err := e.checkpoint(seg, entries, texts); err != nil {
+		return err
+	}
+	if err := e.removeWals(walID); err != nil {
+		return err
 	}
 	e.Lock()
-	for _, key := range keys {
-		e.cache.Del(key)
+	var size int64
+	for i, key := range keys {
+		// flush期间被覆盖写入的key留在缓存里, 下次再落盘
+		if node := e.cache.Get(key); node != nil && &node.Val().([]byte)[0] == &bucket[i][0] {
+			e.cache.Del(key)
+			size += int64(len(bucket[i]))
+		}
 	}
 	e.Unlock()
+	atomic.AddInt64(&e.memBytes, -size)
+	return nil
+}
+
+// kickFlush 缓存达到刷盘大小时立即刷盘, 不等定时器
+func (e *KvEngine) kickFlush() {
+	select {
+	case e.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// checkpoint 段文件落盘, 然后把这次写入的索引追加到索引文件和全文索引文件
+// 索引文件写失败不影响数据, 下次启动时会从段文件补上
+func (e *KvEngine) checkpoint(seg *segment, entries, texts []indexEntry) error {
+	if err := seg.fd.Sync(); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := appendIndexFile(indexName(e.meta.dirname, seg.id), seg.sealer, e.indexFields(), entries, seg.length()); err != nil {
+		log.Printf("segment %d: checkpoint index: %v", seg.id, err)
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+	if err := appendIndexFile(textName(e.meta.dirname, seg.id), seg.sealer, e.meta.textFields, texts, seg.length()); err != nil {
+		log.Printf("segment %d: checkpoint text index: %v", seg.id, err)
+	}
 	return nil
 }
@@ -0,0 +1,228 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 索引文件和段文件一一对应, 记录段内每条数据的key和位置
+// 文件头: magic | 密钥编号 | 字段数 | 字段名...
+// 之后每次flush追加一个检查点, 和块一样带长度和校验和, 按段的密钥加密
+// 检查点: 条数 | 覆盖到的段偏移 | 条目...
+// 条目: key | 块偏移 | 块内偏移 | 每个字段的值
+// 字段名和值都是 uint32 长度 | 内容, 全文字段的值可能超过64KB
+const indexExt = ".idx"
+
+// 格式变化时换一个magic, 旧的文件按过期处理, 启动时从段文件重建
+var indexMagic = []byte("LKI3")
+
+var (
+	ErrStaleIndex = errors.New("stale index file")
+)
+
+type indexEntry struct {
+	key     primitive.ObjectID
+	offset  int64
+	inblock int32
+	fields  []string
+}
+
+func indexName(dirname string, id int64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%020d%s", id, indexExt))
+}
+
+// 重写整个索引文件时每个检查点最多的条数
+const indexChunkSize = 64 * 1024
+
+func encodeIndexHeader(keyID uint32, fields []string) []byte {
+	var buf bytes.Buffer
+	buf.Write(indexMagic)
+	binary.Write(&buf, binary.LittleEndian, keyID)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(fields)))
+	for _, field := range fields {
+		writeIndexString(&buf, field)
+	}
+	return buf.Bytes()
+}
+
+func encodeIndexChunk(sl *sealer, entries []indexEntry, covered int64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	binary.Write(&buf, binary.LittleEndian, covered)
+	for _, en := range entries {
+		buf.Write(en.key[:])
+		binary.Write(&buf, binary.LittleEndian, en.offset)
+		binary.Write(&buf, binary.LittleEndian, en.inblock)
+		for _, v := range en.fields {
+			writeIndexString(&buf, v)
+		}
+	}
+	return encodeRecord(sl.seal(buf.Bytes()))
+}
+
+func writeIndexString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func readIndexString(r io.Reader) (string, error) {
+	var l uint32
+	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return "", err
+	}
+	if l > maxRecordSize {
+		return "", ErrCorrupt
+	}
+	var b = make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// loadIndexFile 读取索引文件, 返回条目和覆盖到的段偏移
+// clean 为false表示文件尾部有损坏的检查点, 需要重写
+func loadIndexFile(name string, sl *sealer, fields []string, size int64) (entries []indexEntry, covered int64, clean bool, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer f.Close()
+	var r = bufio.NewReader(f)
+
+	var magic = make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, indexMagic) {
+		return nil, 0, false, ErrStaleIndex
+	}
+	var keyID uint32
+	if err := binary.Read(r, binary.LittleEndian, &keyID); err != nil || keyID != sl.keyID() {
+		return nil, 0, false, ErrStaleIndex
+	}
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil || int(n) != len(fields) {
+		return nil, 0, false, ErrStaleIndex
+	}
+	for _, field := range fields {
+		name, err := readIndexString(r)
+		if err != nil || name != field {
+			return nil, 0, false, ErrStaleIndex
+		}
+	}
+
+	covered = fileHeaderSize
+	for {
+		chunk, c, err := readIndexChunk(r, sl, len(fields))
+		if err == io.EOF {
+			return entries, covered, true, nil
+		}
+		if err != nil {
+			return entries, covered, false, nil
+		}
+		// 段文件被截断过, 索引已经不可信
+		if c > size {
+			return nil, 0, false, ErrStaleIndex
+		}
+		entries = append(entries, chunk...)
+		covered = c
+	}
+}
+
+func readIndexChunk(r io.Reader, sl *sealer, nfields int) ([]indexEntry, int64, error) {
+	_, sealed, err := readRecord(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, err := sl.open(sealed)
+	if err != nil {
+		return nil, 0, err
+	}
+	var br = bytes.NewReader(body)
+	var count uint32
+	var covered int64
+	if err := binary.Read(br, binary.LittleEndian, &count); err != nil {
+		return nil, 0, ErrCorrupt
+	}
+	if err := binary.Read(br, binary.LittleEndian, &covered); err != nil {
+		return nil, 0, ErrCorrupt
+	}
+	var entries = make([]indexEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var en indexEntry
+		if _, err := io.ReadFull(br, en.key[:]); err != nil {
+			return nil, 0, ErrCorrupt
+		}
+		if err := binary.Read(br, binary.LittleEndian, &en.offset); err != nil {
+			return nil, 0, ErrCorrupt
+		}
+		if err := binary.Read(br, binary.LittleEndian, &en.inblock); err != nil {
+			return nil, 0, ErrCorrupt
+		}
+		for j := 0; j < nfields; j++ {
+			v, err := readIndexString(br)
+			if err != nil {
+				return nil, 0, ErrCorrupt
+			}
+			en.fields = append(en.fields, v)
+		}
+		entries = append(entries, en)
+	}
+	return entries, covered, nil
+}
+
+// appendIndexFile 追加一个检查点
+func appendIndexFile(name string, sl *sealer, fields []string, entries []indexEntry, covered int64) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend|os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := f.Write(encodeIndexHeader(sl.keyID(), fields)); err != nil {
+			return err
+		}
+	}
+	_, err = f.Write(encodeIndexChunk(sl, entries, covered))
+	return err
+}
+
+// rewriteIndexFile 重新生成整个索引文件, 写临时文件后改名
+// 条目多时分成多个检查点, 只在块的边界切分, 每个检查点覆盖到下一个块的偏移
+func rewriteIndexFile(name string, sl *sealer, fields []string, entries []indexEntry, covered int64) error {
+	return writeFileAtomic(name, func(w io.Writer) error {
+		if _, err := w.Write(encodeIndexHeader(sl.keyID(), fields)); err != nil {
+			return err
+		}
+		for {
+			var n = len(entries)
+			if n > indexChunkSize {
+				n = indexChunkSize
+				for n < len(entries) && entries[n].offset == entries[n-1].offset {
+					n++
+				}
+			}
+			var c = covered
+			if n < len(entries) {
+				c = entries[n].offset
+			}
+			if _, err := w.Write(encodeIndexChunk(sl, entries[:n], c)); err != nil {
+				return err
+			}
+			entries = entries[n:]
+			if len(entries) == 0 {
+				return nil
+			}
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package kv
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -9,44 +11,58 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Position 数据在磁盘上的位置: 段编号 + 块在段内的偏移 + 文档在解压后块内的偏移
+type Position struct {
+	Segment int64
+	Offset  int64
+	InBlock int32
+}
+
 type KvIndexer struct {
 	sync.RWMutex
-	pk    *skipmap.Skipmap
-	trace map[string][]primitive.ObjectID
+	pk      *skipmap.Skipmap
+	trace   *Index
+	indexes map[string]*Index
 }
 
-func NewKvIndexer() *KvIndexer {
-	return &KvIndexer{
-		pk:    skipmap.New(),
-		trace: make(map[string][]primitive.ObjectID),
+// NewKvIndexer fields 为要建二级索引的字段
+func NewKvIndexer(fields ...string) *KvIndexer {
+	var i = &KvIndexer{
+		pk:      skipmap.New(),
+		trace:   NewIndex(),
+		indexes: make(map[string]*Index, len(fields)),
+	}
+	for _, field := range fields {
+		i.indexes[field] = NewIndex()
 	}
+	return i
 }
 
-func (i *KvIndexer) Get(id primitive.ObjectID) (int64, bool) {
+func (i *KvIndexer) Get(id primitive.ObjectID) (Position, bool) {
 	i.RLock()
 	defer i.RUnlock()
 	node := i.pk.Get(id)
 	if node != nil {
-		return node.Val().(int64), true
+		return node.Val().(Position), true
 	}
-	return -1, false
+	return Position{}, false
 }
 
-func (i *KvIndexer) GetMin(key primitive.ObjectID) (offset int64, ok bool) {
+func (i *KvIndexer) GetMin(key primitive.ObjectID) (pos Position, ok bool) {
 	i.RLock()
 	defer i.RUnlock()
 	node := i.pk.FirstInRange(skipmap.Range{
 		Min: key,
-		Max: primitive.NewObjectID(),
+		Max: MaxKey,
 	})
 
 	if node == nil {
-		return -1, false
+		return Position{}, false
 	}
-	return node.Val().(int64), true
+	return node.Val().(Position), true
 }
 
-func (i *KvIndexer) GetMax(key primitive.ObjectID) (offset int64, ok bool) {
+func (i *KvIndexer) GetMax(key primitive.ObjectID) (pos Position, ok bool) {
 	i.RLock()
 	defer i.RUnlock()
 
@@ -55,61 +71,317 @@ func (i *KvIndexer) GetMax(key primitive.ObjectID) (offset int64, ok bool) {
 		Max: key,
 	})
 	if node == nil {
-		return -1, false
+		return Position{}, false
+	}
+	return node.Val().(Position), true
+}
+
+// Range 按key的顺序返回 [start, end] 内最多limit个key和位置, reverse 时从end开始倒序
+func (i *KvIndexer) Range(start, end primitive.ObjectID, limit int, reverse bool) ([]primitive.ObjectID, []Position) {
+	i.RLock()
+	defer i.RUnlock()
+	var keys []primitive.ObjectID
+	var positions []Position
+	for node := firstNode(i.pk, start, end, reverse); node != nil && len(keys) < limit; node = nextNode(node, start, end, reverse) {
+		keys = append(keys, node.Key())
+		positions = append(positions, node.Val().(Position))
+	}
+	return keys, positions
+}
+
+// firstNode 正序时为范围内的第一个节点, 倒序时为最后一个
+func firstNode(m *skipmap.Skipmap, start, end primitive.ObjectID, reverse bool) *skipmap.Node {
+	if reverse {
+		return m.LastInRange(skipmap.Range{Min: start, Max: end})
+	}
+	return m.FirstInRange(skipmap.Range{Min: start, Max: end})
+}
+
+// nextNode 按遍历方向的下一个节点, 超出范围时返回nil
+func nextNode(node *skipmap.Node, start, end primitive.ObjectID, reverse bool) *skipmap.Node {
+	if reverse {
+		node = node.Prev()
+		if node == nil || compareKey(node.Key(), start) < 0 {
+			return nil
+		}
+		return node
+	}
+	node = node.Next()
+	if node == nil || compareKey(node.Key(), end) > 0 {
+		return nil
 	}
-	return node.Val().(int64), true
+	return node
 }
 
-func (i *KvIndexer) Set(id primitive.ObjectID, offset int64) {
+func (i *KvIndexer) Set(id primitive.ObjectID, pos Position) {
 	i.Lock()
 	defer i.Unlock()
-	i.pk.Set(id, offset)
+	i.pk.Set(id, pos)
 }
 
-func (i *KvIndexer) SetTrace(trace string, ids ...primitive.ObjectID) {
+// DelKeys 删除仍然指向某个段的key, 分批加锁, 不长时间阻塞读写
+// 返回删除了的key, 已经被覆盖写到其他段的key不删除
+func (i *KvIndexer) DelKeys(segment int64, keys []primitive.ObjectID) []primitive.ObjectID {
+	var deleted = make([]primitive.ObjectID, 0, len(keys))
+	for len(keys) > 0 {
+		var n = len(keys)
+		if n > 1024 {
+			n = 1024
+		}
+		i.Lock()
+		for _, key := range keys[:n] {
+			node := i.pk.Get(key)
+			if node != nil && node.Val().(Position).Segment == segment {
+				i.pk.Del(key)
+				deleted = append(deleted, key)
+			}
+		}
+		i.Unlock()
+		keys = keys[n:]
+	}
+	return deleted
+}
+
+// DelSegment 删除指向某个段的所有索引, 返回删除了的key
+func (i *KvIndexer) DelSegment(segment int64) []primitive.ObjectID {
 	i.Lock()
 	defer i.Unlock()
-	i.trace[trace] = append(i.trace[trace], ids...)
+	var keys []primitive.ObjectID
+	var iter = i.pk.ToIter()
+	for iter.HasNext() {
+		node := iter.Next()
+		if node.Val().(Position).Segment == segment {
+			keys = append(keys, node.Key())
+		}
+	}
+	for _, key := range keys {
+		i.pk.Del(key)
+	}
+	return keys
 }
 
+func (i *KvIndexer) SetTrace(trace string, ids ...primitive.ObjectID) {
+	i.trace.Set(trace, ids...)
+}
+
+// GetTrace 返回链路下所有的key, 按key排序也就是按时间排序
 func (i *KvIndexer) GetTrace(trace string) []primitive.ObjectID {
-	i.RLock()
-	defer i.RUnlock()
-	return i.trace[trace]
+	return i.trace.Get(trace)
+}
+
+// TracePage 链路下不小于start的最多n个key
+func (i *KvIndexer) TracePage(trace string, start primitive.ObjectID, n int) []primitive.ObjectID {
+	return i.trace.Page(trace, start, n)
+}
+
+// Index 字段的二级索引, 没有声明过的字段返回nil
+func (i *KvIndexer) Index(field string) *Index {
+	return i.indexes[field]
 }
 
+// Index 二级索引, 字段值 -> 按key排序的key列表
+// 新写入的key基本都是最大的, 插入时大多是追加; 读取时从游标二分查找, 每次只复制一批
 type Index struct {
 	sync.RWMutex
-	i map[string][]int64
+	i map[string][]primitive.ObjectID
+	// 按 compareIndexValue 排序的字段值, 用于范围查询, 增删字段值时二分查找插入和删除
+	// 数值相等的不同写法, 例如 "1e3" 和 "1000", 再按字符串排序
+	values []string
 }
 
 func NewIndex() *Index {
 	return &Index{
-		i: make(map[string][]int64),
+		i: make(map[string][]primitive.ObjectID),
 	}
 }
 
-func (i *Index) Set(key string, offset int64) {
+func (i *Index) Set(value string, ids ...primitive.ObjectID) {
 	i.Lock()
 	defer i.Unlock()
-	if _, ok := i.i[key]; ok {
-		i.i[key] = append(i.i[key], offset)
-		return
+	if _, ok := i.i[value]; !ok {
+		var j = i.searchValue(value, true)
+		i.values = append(i.values, "")
+		copy(i.values[j+1:], i.values[j:])
+		i.values[j] = value
+	}
+	var list = i.i[value]
+	for _, id := range ids {
+		list = insertKey(list, id)
+	}
+	i.i[value] = list
+}
+
+// searchValue 第一个不小于value的字段值的位置, exact 为false时数值相等的都算
+func (i *Index) searchValue(value string, exact bool) int {
+	return sort.Search(len(i.values), func(j int) bool {
+		var c = compareIndexValue(i.values[j], value)
+		if c == 0 && exact {
+			c = strings.Compare(i.values[j], value)
+		}
+		return c >= 0
+	})
+}
+
+// insertKey 把id插入有序的列表, 已经存在时不变
+func insertKey(list []primitive.ObjectID, id primitive.ObjectID) []primitive.ObjectID {
+	var n = len(list)
+	if n == 0 || compareKey(list[n-1], id) < 0 {
+		return append(list, id)
+	}
+	var j = searchKey(list, id)
+	if list[j] == id {
+		return list
 	}
-	i.i[key] = []int64{offset}
+	list = append(list, primitive.NilObjectID)
+	copy(list[j+1:], list[j:])
+	list[j] = id
+	return list
 }
-func (i *Index) Get(key string) []int64 {
+
+// searchKey 有序列表中第一个不小于start的位置
+func searchKey(list []primitive.ObjectID, start primitive.ObjectID) int {
+	return sort.Search(len(list), func(j int) bool { return compareKey(list[j], start) >= 0 })
+}
+
+// pageKeys 有序列表中从start开始的最多n个key
+func pageKeys(list []primitive.ObjectID, start primitive.ObjectID, n int) []primitive.ObjectID {
+	list = list[searchKey(list, start):]
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// Get 等于value的所有key, 按key排序
+func (i *Index) Get(value string) []primitive.ObjectID {
+	i.RLock()
+	defer i.RUnlock()
+	return append([]primitive.ObjectID(nil), i.i[value]...)
+}
+
+// Page 等于value且不小于start的最多n个key, 按key排序
+func (i *Index) Page(value string, start primitive.ObjectID, n int) []primitive.ObjectID {
 	i.RLock()
 	defer i.RUnlock()
-	return i.i[key]
+	return append([]primitive.ObjectID(nil), pageKeys(i.i[value], start, n)...)
 }
 
-func (i *Index) Clone() map[string][]int64 {
+// Intersect 同时在所有values下, 不小于start且不大于end的最多n个key, 按key排序
+// 每个列表从当前的key二分查找, 有列表的下一个key更大时跳过去, 不复制整个列表
+func (i *Index) Intersect(values []string, start, end primitive.ObjectID, n int) []primitive.ObjectID {
 	i.RLock()
 	defer i.RUnlock()
-	var m = make(map[string][]int64, len(i.i))
-	for k, v := range i.i {
-		m[k] = v
+	var lists = make([][]primitive.ObjectID, len(values))
+	for j, v := range values {
+		if lists[j] = i.i[v]; len(lists[j]) == 0 {
+			return nil
+		}
+	}
+	var keys []primitive.ObjectID
+	for cur := start; len(keys) < n; {
+		var match = true
+		for j := range lists {
+			lists[j] = lists[j][searchKey(lists[j], cur):]
+			if len(lists[j]) == 0 {
+				return keys
+			}
+			if compareKey(lists[j][0], cur) > 0 {
+				cur, match = lists[j][0], false
+			}
+		}
+		if compareKey(cur, end) > 0 {
+			return keys
+		}
+		if !match {
+			continue
+		}
+		keys = append(keys, cur)
+		var ok bool
+		if cur, ok = NextKey(cur); !ok {
+			return keys
+		}
+	}
+	return keys
+}
+
+// RangePage 值在 [min, max] 内且不小于start的最多n个key, 按key排序
+// 值按 compareIndexValue 比较, min/max 为空不限制
+func (i *Index) RangePage(min, max string, start primitive.ObjectID, n int) []primitive.ObjectID {
+	i.RLock()
+	defer i.RUnlock()
+	var from = 0
+	if min != "" {
+		from = i.searchValue(min, false)
+	}
+	var ids []primitive.ObjectID
+	for _, v := range i.values[from:] {
+		if max != "" && compareIndexValue(v, max) > 0 {
+			break
+		}
+		ids = append(ids, pageKeys(i.i[v], start, n)...)
+	}
+	ids = sortKeys(ids)
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// Del 删除value下的一些key
+func (i *Index) Del(value string, ids []primitive.ObjectID) {
+	var del = keySet(ids)
+	i.Lock()
+	defer i.Unlock()
+	i.del(value, del)
+}
+
+// DelKeys 不知道key的字段值时遍历所有的值删除
+func (i *Index) DelKeys(ids []primitive.ObjectID) {
+	var del = keySet(ids)
+	i.Lock()
+	defer i.Unlock()
+	for value := range i.i {
+		i.del(value, del)
+	}
+}
+
+func (i *Index) del(value string, del map[primitive.ObjectID]struct{}) {
+	var ids = i.i[value]
+	var n = 0
+	for _, id := range ids {
+		if _, ok := del[id]; !ok {
+			ids[n] = id
+			n++
+		}
+	}
+	if n > 0 {
+		i.i[value] = ids[:n]
+		return
+	}
+	if _, ok := i.i[value]; ok {
+		delete(i.i, value)
+		var j = i.searchValue(value, true)
+		i.values = append(i.values[:j], i.values[j+1:]...)
+	}
+}
+
+func keySet(ids []primitive.ObjectID) map[primitive.ObjectID]struct{} {
+	var set = make(map[primitive.ObjectID]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// sortKeys 排序并去掉重复的key
+func sortKeys(ids []primitive.ObjectID) []primitive.ObjectID {
+	sort.Slice(ids, func(a, b int) bool { return compareKey(ids[a], ids[b]) < 0 })
+	var n = 0
+	for j, id := range ids {
+		if j == 0 || id != ids[n-1] {
+			ids[n] = id
+			n++
+		}
 	}
-	return m
+	return ids[:n]
 }
@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 字段值增删之后范围查询仍然按数值比较, 数值相等的不同写法都在范围内, 删除时不会删错
+func TestIndexRangePage(t *testing.T) {
+	var idx = NewIndex()
+	var keys = make([]primitive.ObjectID, 8)
+	for j := range keys {
+		keys[j] = primitive.NewObjectID()
+	}
+	var values = []string{"1000", "1e3", "01000", "250.5", "12", "-3", "abc", "b"}
+	for j, v := range values {
+		idx.Set(v, keys[j])
+	}
+	idx.Del("1e3", []primitive.ObjectID{keys[1]})
+	idx.Set("99", keys[1])
+	idx.DelKeys([]primitive.ObjectID{keys[7]})
+
+	var cases = []struct {
+		min, max string
+		start    int
+		n        int
+		want     []int
+	}{
+		{"", "", 0, 10, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"1000", "1000", 0, 10, []int{0, 2}},
+		{"12", "250.5", 0, 10, []int{1, 3, 4}},
+		{"", "0", 0, 10, []int{5}},
+		{"a", "", 0, 10, []int{6}},
+		{"", "", 2, 3, []int{2, 3, 4}},
+		{"1e2", "", 1, 2, []int{2, 3}},
+	}
+	for _, c := range cases {
+		var want []primitive.ObjectID
+		for _, j := range c.want {
+			want = append(want, keys[j])
+		}
+		if got := idx.RangePage(c.min, c.max, keys[c.start], c.n); !reflect.DeepEqual(got, want) {
+			t.Fatalf("[%q, %q] from %d: got %v, want %v", c.min, c.max, c.start, got, want)
+		}
+	}
+	if len(idx.values) != len(idx.i) {
+		t.Fatalf("values %q out of sync", idx.values)
+	}
+}
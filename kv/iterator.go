@@ -0,0 +1,137 @@
+package kv
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 每次从缓存和索引中各取出的条数
+const iterBatch = 256
+
+// Iterator 按key的顺序遍历缓存和磁盘上的数据, 不会一次把整个范围读进内存
+//
+// 每批先取缓存再取索引, flush先写索引再删缓存, 所以一个key至少会在其中一个里被看到
+// 两边取满的批次只有到较近的最后一个key为止是完整的, 超过的部分留到下一批
+// 同一个key同时在缓存和磁盘上时以缓存为准
+type Iterator struct {
+	e       *KvEngine
+	start   primitive.ObjectID
+	end     primitive.ObjectID
+	reverse bool
+	done    bool
+
+	memKeys  []primitive.ObjectID
+	memVals  [][]byte
+	diskKeys []primitive.ObjectID
+	diskPos  []Position
+
+	key primitive.ObjectID
+	val []byte
+	err error
+}
+
+// NewIterator 遍历 [start, end], reverse 时从end开始倒序
+func (e *KvEngine) NewIterator(start, end primitive.ObjectID, reverse bool) *Iterator {
+	return &Iterator{
+		e:       e,
+		start:   start,
+		end:     end,
+		reverse: reverse,
+		done:    compareKey(start, end) > 0,
+	}
+}
+
+// Next 移动到下一条, 没有数据或者出错时返回false
+func (it *Iterator) Next() bool {
+	for {
+		if len(it.memKeys) == 0 && len(it.diskKeys) == 0 {
+			if it.done || it.err != nil {
+				return false
+			}
+			it.fill()
+			continue
+		}
+		var fromMem = len(it.diskKeys) == 0 ||
+			(len(it.memKeys) > 0 && !it.before(it.diskKeys[0], it.memKeys[0]))
+		if fromMem {
+			it.key, it.val = it.memKeys[0], it.memVals[0]
+			if len(it.diskKeys) > 0 && it.diskKeys[0] == it.key {
+				it.diskKeys, it.diskPos = it.diskKeys[1:], it.diskPos[1:]
+			}
+			it.memKeys, it.memVals = it.memKeys[1:], it.memVals[1:]
+			return true
+		}
+		var pos = it.diskPos[0]
+		it.key = it.diskKeys[0]
+		it.diskKeys, it.diskPos = it.diskKeys[1:], it.diskPos[1:]
+		val, err := it.e.get(pos)
+		if err != nil {
+			// 段已经被保留策略删除
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			it.err = err
+			return false
+		}
+		it.val = val
+		return true
+	}
+}
+
+// before a 在遍历的方向上排在 b 前面
+func (it *Iterator) before(a, b primitive.ObjectID) bool {
+	if it.reverse {
+		return compareKey(a, b) > 0
+	}
+	return compareKey(a, b) < 0
+}
+
+// fill 取下一批, 覆盖从当前位置到bound, 下一批从bound之后继续
+func (it *Iterator) fill() {
+	memKeys, memVals := it.e.cacheRange(it.start, it.end, iterBatch, it.reverse)
+	diskKeys, diskPos := it.e.indexer.Range(it.start, it.end, iterBatch, it.reverse)
+
+	var bound = it.end
+	if it.reverse {
+		bound = it.start
+	}
+	if len(memKeys) == iterBatch && it.before(memKeys[len(memKeys)-1], bound) {
+		bound = memKeys[len(memKeys)-1]
+	}
+	if len(diskKeys) == iterBatch && it.before(diskKeys[len(diskKeys)-1], bound) {
+		bound = diskKeys[len(diskKeys)-1]
+	}
+	for len(memKeys) > 0 && it.before(bound, memKeys[len(memKeys)-1]) {
+		memKeys, memVals = memKeys[:len(memKeys)-1], memVals[:len(memVals)-1]
+	}
+	for len(diskKeys) > 0 && it.before(bound, diskKeys[len(diskKeys)-1]) {
+		diskKeys, diskPos = diskKeys[:len(diskKeys)-1], diskPos[:len(diskPos)-1]
+	}
+	it.memKeys, it.memVals = memKeys, memVals
+	it.diskKeys, it.diskPos = diskKeys, diskPos
+
+	var ok bool
+	switch {
+	case it.reverse && bound == it.start, !it.reverse && bound == it.end:
+		it.done = true
+	case it.reverse:
+		it.end, ok = PrevKey(bound)
+		it.done = !ok
+	default:
+		it.start, ok = NextKey(bound)
+		it.done = !ok
+	}
+}
+
+func (it *Iterator) Key() primitive.ObjectID {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,101 @@
+package kv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 倒序遍历的key交替落在多个段和缓存里, 缓存里还有覆盖了磁盘上的key, 超过一批的条数
+// 开始和结束的key都包含在结果里, 不管它们在缓存里还是在磁盘上
+func TestReverseIterator(t *testing.T) {
+	var e = newTestEngine(t, WithSegmentSize(2*1024), WithCompression(CompressNone, 1024), WithSyncPolicy(SyncNone, 0))
+	defer e.cleanup()
+
+	const n = 1000
+	var keys = make([]primitive.ObjectID, n)
+	var values = make(map[primitive.ObjectID][]byte)
+	var base = primitive.NewObjectID()
+	var set = func(i, v int) {
+		var key = base
+		key[10], key[11] = byte(i>>8), byte(i)
+		data, _ := bson.Marshal(bson.M{"_id": key, "i": i, "v": v})
+		if _, err := e.Set(data); err != nil {
+			t.Fatal(err)
+		}
+		keys[i], values[key] = key, data
+	}
+	// 偶数落盘, 奇数和每7个偶数的新值在缓存里
+	for i := 0; i < n; i += 2 {
+		set(i, 0)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.segments) < 3 {
+		t.Fatalf("%d segments, want several", len(e.segments))
+	}
+	for i := 0; i < n; i++ {
+		if i%2 == 1 {
+			set(i, 0)
+		} else if i%14 == 0 {
+			set(i, 1)
+		}
+	}
+
+	var cases = []struct {
+		name       string
+		start, end int
+	}{
+		{"all", 0, n - 1},
+		{"disk to disk", 2, 998},
+		{"memory to memory", 1, 997},
+		{"disk to memory", 300, 901},
+		{"memory to disk", 301, 900},
+		{"overwritten bounds", 14, 980},
+		{"single", 501, 501},
+		{"within a batch", 400, 410},
+	}
+	for _, c := range cases {
+		var start, end = keys[c.start], keys[c.end]
+		var want []primitive.ObjectID
+		for i := c.end; i >= c.start; i-- {
+			want = append(want, keys[i])
+		}
+		var got []primitive.ObjectID
+		var it = e.NewIterator(start, end, true)
+		for it.Next() {
+			if !bytes.Equal(it.Value(), values[it.Key()]) {
+				t.Fatalf("%s: value of %s is stale", c.name, it.Key().Hex())
+			}
+			got = append(got, it.Key())
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %d keys, want %d", c.name, len(got), len(want))
+		}
+
+		// 倒序分页, 下一页到上一页最后一条的 PrevKey 为止
+		got = got[:0]
+		for page, more := end, true; more; {
+			datas, m, err := e.ScanRange(start, page, ScanOptions{Limit: 97, Reverse: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range datas {
+				got = append(got, DocKey(data))
+			}
+			if more = m; more {
+				page, _ = PrevKey(DocKey(datas[len(datas)-1]))
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: paged scan got %d keys, want %d", c.name, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var (
+	ErrOffsetExpired = errors.New("offset expired, segment dropped by retention")
+	ErrInvalidOffset = errors.New("invalid offset")
+)
+
+// Change 变更流里的一条数据, Pos 为它在段里的位置
+// 变更流按落盘的顺序读取段文件, 数据刷盘之后才能读到, 覆盖写入会再出现一次
+type Change struct {
+	Key  primitive.ObjectID
+	Data []byte
+	Pos  Position
+}
+
+// Changes 从pos开始按落盘的顺序读取最多limit条, 返回数据和下一次读取的位置
+// maxSize 大于0时限制数据的总大小, 至少返回一条; pos 为空时从最老的段开始
+// 已经读到最新时返回空的数据和原来的位置
+func (e *KvEngine) Changes(pos Position, limit, maxSize int) ([]Change, Position, error) {
+	pos, err := e.startPosition(pos)
+	if err != nil {
+		return nil, pos, err
+	}
+	var changes []Change
+	var size int
+	for len(changes) < limit {
+		seg := e.segment(pos.Segment)
+		if seg == nil {
+			return changes, pos, ErrOffsetExpired
+		}
+		if pos.Offset >= seg.length() {
+			// 有更新的段说明这个段已经写完了
+			next := e.nextSegment(seg.id)
+			if next == nil {
+				break
+			}
+			pos = Position{Segment: next.id, Offset: fileHeaderSize}
+			continue
+		}
+		n, body, err := seg.readAt(pos.Offset)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				err = ErrOffsetExpired
+			}
+			return changes, pos, err
+		}
+		var full bool
+		err = eachBlockDoc(body, func(inblock int32, doc bsoncore.Document) bool {
+			if inblock < pos.InBlock {
+				return true
+			}
+			if len(changes) >= limit || (maxSize > 0 && len(changes) > 0 && size+len(doc) > maxSize) {
+				full = true
+				pos.InBlock = inblock
+				return false
+			}
+			key, err := ReadIndex(doc)
+			if err != nil {
+				return true
+			}
+			changes = append(changes, Change{
+				Key:  key,
+				Data: doc,
+				Pos:  Position{Segment: pos.Segment, Offset: pos.Offset, InBlock: inblock},
+			})
+			size += len(doc)
+			return true
+		})
+		if err != nil {
+			return changes, pos, err
+		}
+		if full {
+			break
+		}
+		pos = Position{Segment: pos.Segment, Offset: pos.Offset + int64(n)}
+	}
+	return changes, pos, nil
+}
+
+// startPosition 空的位置换成最老的段的开头
+func (e *KvEngine) startPosition(pos Position) (Position, error) {
+	if pos.Segment == 0 {
+		return e.firstPosition(), nil
+	}
+	if pos.Offset < fileHeaderSize {
+		pos.Offset, pos.InBlock = fileHeaderSize, 0
+	}
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	if pos.Segment < e.segments[0].id {
+		return pos, ErrOffsetExpired
+	}
+	var last = e.segments[len(e.segments)-1]
+	if pos.Segment > last.id || (pos.Segment == last.id && pos.Offset > last.length()) {
+		return pos, ErrInvalidOffset
+	}
+	return pos, nil
+}
+
+func (e *KvEngine) firstPosition() Position {
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	return Position{Segment: e.segments[0].id, Offset: fileHeaderSize}
+}
+
+// nextSegment 编号大于id的第一个段
+func (e *KvEngine) nextSegment(id int64) *segment {
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	for _, seg := range e.segments {
+		if seg.id > id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// ConsumerOffset 消费者下一次要读的位置, 第一次使用时注册, 从最老的段开始
+func (e *KvEngine) ConsumerOffset(name string) (Position, error) {
+	if err := checkConsumer(name); err != nil {
+		return Position{}, err
+	}
+	if pos, ok := e.consumers.get(name); ok {
+		return pos, nil
+	}
+	return e.consumers.add(name, e.firstPosition())
+}
+
+// CommitOffset 保存消费者处理到的位置, 一般为 Changes 返回的下一次读取的位置或者某条数据的 Pos
+// 不在块和文档边界上的位置返回 ErrInvalidOffset, 否则之后每次读取都会失败
+func (e *KvEngine) CommitOffset(name string, pos Position) error {
+	if err := checkConsumer(name); err != nil {
+		return err
+	}
+	pos, err := e.startPosition(pos)
+	if err != nil {
+		return err
+	}
+	if err := e.checkPosition(pos); err != nil {
+		return err
+	}
+	return e.consumers.set(name, pos)
+}
+
+// checkPosition 段的末尾, 或者能读出的块里某个文档的开头
+func (e *KvEngine) checkPosition(pos Position) error {
+	seg := e.segment(pos.Segment)
+	if seg == nil {
+		return ErrOffsetExpired
+	}
+	if pos.Offset == seg.length() && pos.InBlock == 0 {
+		return nil
+	}
+	_, body, err := seg.readAt(pos.Offset)
+	if errors.Is(err, os.ErrClosed) {
+		return ErrOffsetExpired
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOffset, err)
+	}
+	var ok bool
+	eachBlockDoc(body, func(inblock int32, doc bsoncore.Document) bool {
+		ok = inblock == pos.InBlock
+		return inblock < pos.InBlock
+	})
+	if !ok {
+		return fmt.Errorf("%w: %d not a document boundary", ErrInvalidOffset, pos.InBlock)
+	}
+	return nil
+}
+
+// RemoveConsumer 删除消费者, 之后保留策略不再为它保留数据
+func (e *KvEngine) RemoveConsumer(name string) error {
+	return e.consumers.del(name)
+}
+
+// Consumers 所有消费者提交的位置
+func (e *KvEngine) Consumers() map[string]Position {
+	return e.consumers.all()
+}
+
+// retainedByConsumer 段里还有消费者没读的数据
+func (e *KvEngine) retainedByConsumer(seg *segment) bool {
+	if !e.meta.consumerRetention {
+		return false
+	}
+	min, ok := e.consumers.minSegment()
+	return ok && seg.id >= min
+}
+
+func checkConsumer(name string) error {
+	if name == "" || strings.TrimSpace(name) != name {
+		return ErrInvalidConsumer
+	}
+	return nil
+}
+
+// Head 变更流的末尾, 也就是下一块数据落盘的位置
+func (e *KvEngine) Head() Position {
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	var last = e.segments[len(e.segments)-1]
+	return Position{Segment: last.id, Offset: last.length()}
+}
+
+// LagBytes 从pos到变更流末尾还有多少字节没读, 用来衡量消费者和从节点的延迟
+func (e *KvEngine) LagBytes(pos Position) int64 {
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	var lag int64
+	for _, seg := range e.segments {
+		switch {
+		case seg.id == pos.Segment && pos.Offset < seg.length():
+			lag += seg.length() - pos.Offset
+		case seg.id > pos.Segment:
+			lag += seg.length() - fileHeaderSize
+		}
+	}
+	return lag
+}
@@ -1,71 +1,116 @@
 package kv
 
 import (
-	"io"
-	"os"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// 删除ts时间之前的数据  重建索引
+// 删除ts时间之前的数据  整段删除, 当前写入的段不删除
 func (e *KvEngine) Del(ts uint32) error {
 	var key = primitive.NewObjectIDFromTimestamp(time.Unix(int64(ts), 0))
-	offset, ok := e.indexer.GetMax(key)
-	if !ok {
-		return ErrNotFound
-	}
-	e.Lock()
-	defer e.Unlock()
-	// 备份文件
-	f, err := os.OpenFile(e.meta.filename+".bak", os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend|os.ModePerm)
+	n, err := e.dropSegments(func(seg *segment, remain int64) bool {
+		_, max := seg.bounds()
+		return compareKey(max, key) < 0
+	})
 	if err != nil {
 		return err
 	}
-	_, err = e.fd.Seek(offset, 0)
-	if err != nil {
-		return err
+	if n == 0 {
+		return ErrNotFound
 	}
-	var buf = make([]byte, 1024)
-	for {
-		n, err := e.fd.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+	return nil
+}
+
+// dropSegments 从最老的段开始整段删除, 直到 expired 返回false
+// remain 为删除这个段之前所有段的总大小, 当前写入的段不删除
+func (e *KvEngine) dropSegments(expired func(seg *segment, remain int64) bool) (int, error) {
+	e.segLock.Lock()
+	var remain int64
+	for _, seg := range e.segments {
+		remain += seg.length()
+	}
+	var dropped []*segment
+	var i = 0
+	for ; i < len(e.segments)-1; i++ {
+		seg := e.segments[i]
+		if !expired(seg, remain) {
+			break
 		}
-		_, err = f.Write(buf[:n])
-		if err != nil {
-			return err
+		remain -= seg.length()
+		dropped = append(dropped, seg)
+	}
+	e.segments = e.segments[i:]
+	e.segLock.Unlock()
+
+	for i, seg := range dropped {
+		e.dropIndexes(seg)
+		e.blocks.DelSegment(seg.id)
+		if err := seg.remove(); err != nil {
+			return i, err
 		}
 	}
+	return len(dropped), nil
+}
 
-	err = e.fd.Truncate(0)
+// dropIndexes 删除段内数据的索引, 优先按索引文件里的key删除, 避免遍历整个索引
+// 链路索引, 二级索引和全文索引也按索引文件里记录的字段值删除
+func (e *KvEngine) dropIndexes(seg *segment) {
+	entries, _, _, err := loadIndexFile(indexName(e.meta.dirname, seg.id), seg.sealer, e.indexFields(), seg.length())
 	if err != nil {
-		return err
+		var keys = e.indexer.DelSegment(seg.id)
+		for _, idx := range e.indexes {
+			idx.DelKeys(keys)
+		}
+		e.dropText(seg, keys)
+		return
 	}
-	_, err = e.fd.Seek(0, 0)
-	if err != nil {
-		return err
+	var keys = make([]primitive.ObjectID, 0, len(entries))
+	for _, en := range entries {
+		keys = append(keys, en.key)
+	}
+	var deleted = e.indexer.DelKeys(seg.id, keys)
+	var del = keySet(deleted)
+	for j, idx := range e.indexes {
+		dropValues(idx, entries, del, func(en indexEntry) []string { return en.fields[j : j+1] })
+	}
+	e.dropText(seg, deleted)
+}
+
+// dropText 删除全文索引里已经删除了的key
+func (e *KvEngine) dropText(seg *segment, deleted []primitive.ObjectID) {
+	if e.text == nil || len(deleted) == 0 {
+		return
 	}
-	_, err = f.Seek(0, 0)
+	entries, _, _, err := loadIndexFile(textName(e.meta.dirname, seg.id), seg.sealer, e.meta.textFields, seg.length())
 	if err != nil {
-		return err
+		e.text.DelKeys(deleted)
+		return
 	}
-	for {
-		n, err := f.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+	dropValues(e.text, entries, keySet(deleted), func(en indexEntry) []string {
+		var terms []string
+		for _, v := range en.fields {
+			terms = append(terms, strings.Fields(v)...)
 		}
-		_, err = e.fd.Write(buf[:n])
-		if err != nil {
-			return err
+		return terms
+	})
+}
+
+// dropValues 按索引文件里记录的值, 从索引里删除del中的key
+func dropValues(idx *Index, entries []indexEntry, del map[primitive.ObjectID]struct{}, values func(en indexEntry) []string) {
+	var keys = make(map[string][]primitive.ObjectID)
+	for _, en := range entries {
+		if _, ok := del[en.key]; !ok {
+			continue
+		}
+		for _, v := range values(en) {
+			if v != "" {
+				keys[v] = append(keys[v], en.key)
+			}
 		}
 	}
-
-	return nil
+	for v, ids := range keys {
+		idx.Del(v, ids)
+	}
 }
@@ -2,11 +2,11 @@ package kv
 
 import (
 	"errors"
-	"io"
-	bytesutils "logkv/bytes-utils"
-	"logkv/protocol"
+	"os"
+	"sort"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 var (
@@ -15,53 +15,104 @@ var (
 
 func (e *KvEngine) Get(id primitive.ObjectID) ([]byte, error) {
 	// 先查询cache
+	e.Lock()
 	node := e.cache.Get(id)
+	e.Unlock()
 	if node != nil {
 		data := node.Val().([]byte)
 		return data, nil
 	}
-	offset, _ := e.indexer.Get(id)
-	return e.get(offset)
+	pos, ok := e.indexer.Get(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e.get(pos)
 }
 
-func (e *KvEngine) get(offset int64) ([]byte, error) {
-	if offset == -1 {
-		return nil, ErrNotFound
+// exists key在缓存或者段文件里, 不读取数据
+func (e *KvEngine) exists(id primitive.ObjectID) bool {
+	e.Lock()
+	node := e.cache.Get(id)
+	e.Unlock()
+	if node != nil {
+		return true
 	}
-	_, err := e.fd.Seek(offset, 0)
+	_, ok := e.indexer.Get(id)
+	return ok
+}
+
+func (e *KvEngine) get(pos Position) ([]byte, error) {
+	body, err := e.readBlock(pos.Segment, pos.Offset)
 	if err != nil {
 		return nil, err
 	}
-	var headerBuf = make([]byte, protocol.HeaderSize)
-	_, err = e.fd.Read(headerBuf)
+	doc, err := blockDoc(body, pos.InBlock)
 	if err != nil {
 		return nil, err
 	}
+	return doc, nil
+}
 
-	dataSize, err := bytesutils.BytesToIntU(headerBuf)
-	if err != nil {
-		return nil, err
+// readBlock 读取解压后的块, 先查块缓存
+func (e *KvEngine) readBlock(segment, offset int64) ([]byte, error) {
+	var key = blockKey{segment: segment, offset: offset}
+	if body, ok := e.blocks.Get(key); ok {
+		return body, nil
 	}
-
-	var data = make([]byte, dataSize)
-	_, err = e.fd.Read(data[4:])
+	seg := e.segment(segment)
+	if seg == nil {
+		return nil, ErrNotFound
+	}
+	body, err := seg.read(offset)
 	if err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			// 段已经被删除
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
-	copy(data[:4], headerBuf)
-	return data, nil
+	e.blocks.Set(key, body)
+	return body, nil
 }
 
-func (e *KvEngine) BatchGet(indexes []primitive.ObjectID) ([][]byte, error) {
-	var kvs = make([][]byte, 0, len(indexes))
-	for _, index := range indexes {
-		kv, err := e.Get(index)
-		if err != nil {
-			return kvs, err
+// BatchGet 批量查询, 返回值和错误都和keys一一对应, 不存在的错误为 ErrNotFound
+// 缓存只加一次锁, 其余的按位置排序后读取, 同一个块只解压一次
+func (e *KvEngine) BatchGet(keys []primitive.ObjectID) ([][]byte, []error) {
+	var kvs = make([][]byte, len(keys))
+	var errs = make([]error, len(keys))
+	var missed = make([]int, 0, len(keys))
+	e.Lock()
+	for i, key := range keys {
+		if node := e.cache.Get(key); node != nil {
+			kvs[i] = node.Val().([]byte)
+		} else {
+			missed = append(missed, i)
+		}
+	}
+	e.Unlock()
+
+	var positions = make(map[int]Position, len(missed))
+	var found = missed[:0]
+	for _, i := range missed {
+		pos, ok := e.indexer.Get(keys[i])
+		if !ok {
+			errs[i] = ErrNotFound
+			continue
+		}
+		positions[i] = pos
+		found = append(found, i)
+	}
+	sort.Slice(found, func(a, b int) bool {
+		pa, pb := positions[found[a]], positions[found[b]]
+		if pa.Segment != pb.Segment {
+			return pa.Segment < pb.Segment
 		}
-		kvs = append(kvs, kv)
+		return pa.Offset < pb.Offset
+	})
+	for _, i := range found {
+		kvs[i], errs[i] = e.get(positions[i])
 	}
-	return kvs, nil
+	return kvs, errs
 }
 
 func (e *KvEngine) Scan(startIndex, endIndex primitive.ObjectID, limits ...int) ([][]byte, error) {
@@ -69,46 +120,82 @@ func (e *KvEngine) Scan(startIndex, endIndex primitive.ObjectID, limits ...int)
 	if len(limits) > 0 {
 		limit = limits[0]
 	}
-	offset, _ := e.indexer.GetMin(startIndex)
+	kvs, _, err := e.ScanRange(startIndex, endIndex, ScanOptions{Limit: limit})
+	return kvs, err
+}
 
-	return e.scan(offset, limit, endIndex, -1)
+// ScanOptions 范围扫描的参数
+type ScanOptions struct {
+	// 最多返回的条数
+	Limit int
+	// 总大小超过后截断, 至少返回一条, 0不限制
+	MaxSize int
+	// 从end开始倒序
+	Reverse bool
+	// 只返回满足条件的数据, nil不过滤
+	Filter *Filter
 }
 
-func (e *KvEngine) scan(offset int64, limit int, endIndex primitive.ObjectID, max int) ([][]byte, error) {
-	if offset == -1 {
-		return nil, ErrNotFound
+// ScanRange 按key的顺序返回 [start, end] 内的数据, 包括还在缓存里没有落盘的
+// more 为true表示结果被截断, 下一页从最后一条的 NextKey 开始, 倒序时到 PrevKey 为止
+func (e *KvEngine) ScanRange(start, end primitive.ObjectID, opts ScanOptions) ([][]byte, bool, error) {
+	var kvs [][]byte
+	var size int
+	var it = e.NewIterator(start, end, opts.Reverse)
+	for it.Next() {
+		var v = it.Value()
+		if opts.Filter != nil && !opts.Filter.Match(v) {
+			continue
+		}
+		if len(kvs) >= opts.Limit || (opts.MaxSize > 0 && len(kvs) > 0 && size+len(v) > opts.MaxSize) {
+			return kvs, true, nil
+		}
+		kvs = append(kvs, v)
+		size += len(v)
 	}
-	_, err := e.fd.Seek(int64(offset), 0)
-	if err != nil {
-		return nil, err
+	return kvs, false, it.Err()
+}
+
+// cacheRange 缓存中 [start, end] 内最多limit条数据, reverse 时从end开始倒序
+func (e *KvEngine) cacheRange(start, end primitive.ObjectID, limit int, reverse bool) ([]primitive.ObjectID, [][]byte) {
+	e.Lock()
+	defer e.Unlock()
+	var keys []primitive.ObjectID
+	var kvs [][]byte
+	for node := firstNode(e.cache, start, end, reverse); node != nil && len(keys) < limit; node = nextNode(node, start, end, reverse) {
+		keys = append(keys, node.Key())
+		kvs = append(kvs, node.Val().([]byte))
 	}
+	return keys, kvs
+}
 
-	var endKey = endIndex.Hex()
-	var readSize = 0
-	var kvs = make([][]byte, 0, limit)
-	for i := 0; i < limit; i++ {
-		n, key, _, data, err := ReadIndex(e.fd, e.traceKey)
-		if err != nil {
-			if err == io.EOF {
-				return kvs, nil
-			}
-			return kvs, err
-		}
-		if len(data) == 0 {
-			return kvs, nil
-		}
+// MaxKey 最大的key, 用作不限制结束位置的扫描范围
+var MaxKey = primitive.ObjectID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
-		if endKey > "" && key.Hex() > endKey {
-			return kvs, nil
-		}
-		kvs = append(kvs, data)
-		if endKey > "" && key.Hex() == endKey {
-			return kvs, nil
+// DocKey 写入时已经校验过_id
+func DocKey(doc []byte) primitive.ObjectID {
+	return bsoncore.Document(doc).Lookup("_id").ObjectID()
+}
+
+// NextKey 紧接着key的下一个key, 用于从上一页的最后一条继续扫描
+// key 已经是最大值时返回false
+func NextKey(key primitive.ObjectID) (primitive.ObjectID, bool) {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]++
+		if key[i] != 0 {
+			return key, true
 		}
-		readSize += n
-		if max > 0 && readSize >= max {
-			return kvs, nil
+	}
+	return key, false
+}
+
+// PrevKey 紧挨着key的上一个key, 用于倒序扫描, key 为0时返回false
+func PrevKey(key primitive.ObjectID) (primitive.ObjectID, bool) {
+	for i := len(key) - 1; i >= 0; i-- {
+		key[i]--
+		if key[i] != 0xff {
+			return key, true
 		}
 	}
-	return kvs, nil
+	return key, false
 }
@@ -0,0 +1,72 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNotIndexed = errors.New("field not indexed")
+
+// Find 按时间顺序返回字段等于value的数据, 分页参数同 Trace
+func (e *KvEngine) Find(field, value string, start primitive.ObjectID, opts ScanOptions) ([][]byte, bool, error) {
+	idx := e.indexer.Index(field)
+	if idx == nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrNotIndexed, field)
+	}
+	return e.lookup(func(start primitive.ObjectID, n int) []primitive.ObjectID {
+		return idx.Page(value, start, n)
+	}, start, opts, func(doc []byte) bool {
+		return fieldValue(doc, field) == value
+	})
+}
+
+// FindRange 按时间顺序返回字段值在 [min, max] 内的数据, min/max 为空不限制
+// 数字按数值比较, 字符串按字典序, 数字排在字符串前面
+func (e *KvEngine) FindRange(field, min, max string, start primitive.ObjectID, opts ScanOptions) ([][]byte, bool, error) {
+	idx := e.indexer.Index(field)
+	if idx == nil {
+		return nil, false, fmt.Errorf("%w: %s", ErrNotIndexed, field)
+	}
+	return e.lookup(func(start primitive.ObjectID, n int) []primitive.ObjectID {
+		return idx.RangePage(min, max, start, n)
+	}, start, opts, func(doc []byte) bool {
+		var v = fieldValue(doc, field)
+		return v != "" && (min == "" || compareIndexValue(v, min) >= 0) && (max == "" || compareIndexValue(v, max) <= 0)
+	})
+}
+
+// lookup 按key的顺序读取page返回的不小于start的数据, page 每次返回从start开始的最多n个有序的key
+// 已经被删除的, 或者覆盖写入后不再满足match的数据跳过
+func (e *KvEngine) lookup(page func(start primitive.ObjectID, n int) []primitive.ObjectID, start primitive.ObjectID, opts ScanOptions, match func(doc []byte) bool) ([][]byte, bool, error) {
+	var kvs [][]byte
+	var size int
+	for {
+		var keys = page(start, iterBatch)
+		datas, errs := e.BatchGet(keys)
+		for i, v := range datas {
+			if errors.Is(errs[i], ErrNotFound) {
+				continue
+			}
+			if errs[i] != nil {
+				return kvs, false, errs[i]
+			}
+			if !match(v) {
+				continue
+			}
+			if len(kvs) >= opts.Limit || (opts.MaxSize > 0 && len(kvs) > 0 && size+len(v) > opts.MaxSize) {
+				return kvs, true, nil
+			}
+			kvs = append(kvs, v)
+			size += len(v)
+		}
+		if len(keys) < iterBatch {
+			return kvs, false, nil
+		}
+		var ok bool
+		if start, ok = NextKey(keys[len(keys)-1]); !ok {
+			return kvs, false, nil
+		}
+	}
+}
@@ -1,64 +1,75 @@
 package kv
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"log"
-	bytesutils "logkv/bytes-utils"
-	"logkv/protocol"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
-func ReadIndexes(r io.Reader, traceKey string, set func(key primitive.ObjectID, trace string, offset int64)) error {
+var (
+	ErrInvalidKey = errors.New("not object id")
+)
+
+// ReadIndexes 顺序读取所有块, 返回完整读取的字节数
+// 遇到不完整或者校验失败的块时停止, 由调用方处理损坏的尾部
+// values 取出每条数据要保存在索引文件里的值, 可以为nil
+func ReadIndexes(r io.Reader, sl *sealer, values func(doc bsoncore.Document) []string, set func(key primitive.ObjectID, values []string, offset int64, inblock int32)) (int64, error) {
 	var offset int64
 	for {
-		n, key, trace, _, err := ReadIndex(r, traceKey)
+		n, body, err := readBlock(r, sl)
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				return offset, nil
 			}
-			return err
+			return offset, err
+		}
+		err = eachBlockDoc(body, func(inblock int32, doc bsoncore.Document) bool {
+			key, err := ReadIndex(doc)
+			if err != nil {
+				log.Println("skip record without _id at", offset, inblock)
+				return true
+			}
+			var vals []string
+			if values != nil {
+				vals = values(doc)
+			}
+			set(key, vals, offset, inblock)
+			return true
+		})
+		if err != nil {
+			return offset, err
 		}
-		log.Println("load", key.Hex(), offset)
-
-		set(key, trace, offset)
 		offset += int64(n)
 	}
 }
 
-func ReadIndex(r io.Reader, traceKey string) (int, primitive.ObjectID, string, []byte, error) {
-	var headerBuf = make([]byte, protocol.HeaderSize)
-	n, err := r.Read(headerBuf)
-	if err != nil {
-		return n, primitive.NilObjectID, "", nil, err
+func ReadIndex(doc bsoncore.Document) (primitive.ObjectID, error) {
+	if err := doc.Validate(); err != nil {
+		return primitive.NilObjectID, ErrInvalidKey
 	}
-	dataSize, err := bytesutils.BytesToIntU(headerBuf)
-	if err != nil {
-		return n, primitive.NilObjectID, "", nil, err
+	key, ok := doc.Lookup("_id").ObjectIDOK()
+	if !ok {
+		return primitive.NilObjectID, ErrInvalidKey
 	}
+	return key, nil
+}
 
-	var data = make([]byte, dataSize)
-	n1, err := r.Read(data[4:])
+// readBlock 读取, 解密并解压一个块
+func readBlock(r io.Reader, sl *sealer) (int, []byte, error) {
+	n, sealed, err := readRecord(r)
 	if err != nil {
-		return n + n1, primitive.NilObjectID, "", nil, err
+		return n, nil, err
 	}
-	copy(data[:4], headerBuf)
-	doc, err := bsoncore.NewDocumentFromReader(bytes.NewBuffer(data))
+	payload, err := sl.open(sealed)
 	if err != nil {
-		return n + n1, primitive.NilObjectID, "", data, err
+		return n, nil, err
 	}
-	_id := doc.Lookup("_id")
-
-	key, ok := _id.ObjectIDOK()
-	if !ok {
-		return n + n1, primitive.NilObjectID, "", data, errors.New("not object id")
-	}
-	var trace string
-	if traceKey != "" {
-		trace = doc.Lookup(traceKey).String()
+	body, err := decodeBlock(payload)
+	if err != nil {
+		return n, nil, ErrCorrupt
 	}
-	return n + n1, key, trace, data, err
+	return n, body, nil
 }
@@ -0,0 +1,57 @@
+package kv
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNoTextIndex = errors.New("full-text index not enabled")
+
+// Search 按时间顺序返回key在 [start, end] 内匹配全文查询的数据, 分页参数同 Trace
+func (e *KvEngine) Search(q *Query, start, end primitive.ObjectID, opts ScanOptions) ([][]byte, bool, error) {
+	if e.text == nil {
+		return nil, false, ErrNoTextIndex
+	}
+	return e.lookup(func(start primitive.ObjectID, n int) []primitive.ObjectID {
+		return q.page(e.text, start, end, n)
+	}, start, opts, func(doc []byte) bool {
+		return q.match(textTokens(doc, e.meta.textFields))
+	})
+}
+
+// SearchKeys 同 Search, 只返回最多limit个key, more 为true表示还有
+// 没有短语时直接返回索引查到的还存在的key, 不读取文档, 覆盖写入之前的词也会匹配
+// 有短语时要读取文档确认词是连续的
+func (e *KvEngine) SearchKeys(q *Query, start, end primitive.ObjectID, limit int) ([]primitive.ObjectID, bool, error) {
+	if e.text == nil {
+		return nil, false, ErrNoTextIndex
+	}
+	var keys []primitive.ObjectID
+	if !q.exact() {
+		datas, more, err := e.Search(q, start, end, ScanOptions{Limit: limit})
+		for _, v := range datas {
+			keys = append(keys, DocKey(v))
+		}
+		return keys, more, err
+	}
+	for {
+		var page = q.page(e.text, start, end, iterBatch)
+		for _, key := range page {
+			if !e.exists(key) {
+				continue
+			}
+			if len(keys) >= limit {
+				return keys, true, nil
+			}
+			keys = append(keys, key)
+		}
+		if len(page) < iterBatch {
+			return keys, false, nil
+		}
+		var ok bool
+		if start, ok = NextKey(page[len(page)-1]); !ok {
+			return keys, false, nil
+		}
+	}
+}
@@ -1,37 +1,248 @@
 package kv
 
 import (
-	"bytes"
-	"log"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
-func (e *KvEngine) Set(data []byte) {
-	e.ch <- data
+var (
+	ErrOverloaded      = errors.New("engine overloaded, retry later")
+	ErrInvalidDocument = errors.New("invalid document")
+	ErrClosed          = errors.New("engine closed")
+)
+
+// 写入队列满时的最长等待时间
+const enqueueTimeout = time.Second
+
+// setReq 一次写入, 写入预写日志并按落盘策略fsync之后通过done返回
+// key 为空表示文档没有_id, 由写入协程分配
+type setReq struct {
+	key  primitive.ObjectID
+	doc  bsoncore.Document
+	data []byte
+	done chan error
+	// 写入缓存时的订阅, 落盘之后推送
+	subs []*Subscription
 }
 
-func (e *KvEngine) BatchSet(datas [][]byte) {
-	for _, v := range datas {
-		e.ch <- v
+// newSetReq 在进入写入队列之前校验文档
+func newSetReq(data []byte) (*setReq, error) {
+	key, doc, err := validate(data)
+	if err != nil {
+		return nil, err
 	}
+	return &setReq{
+		key:  key,
+		doc:  doc,
+		data: data,
+		done: make(chan error, 1),
+	}, nil
 }
 
-func (e *KvEngine) receive() {
-	for data := range e.ch {
-		doc, err := bsoncore.NewDocumentFromReader(bytes.NewBuffer(data))
+// validate 检查是否为完整的bson文档, _id 不存在或者为null时返回空的key, 否则必须是ObjectID
+func validate(data []byte) (primitive.ObjectID, bsoncore.Document, error) {
+	var doc = bsoncore.Document(data)
+	if err := doc.Validate(); err != nil {
+		return primitive.NilObjectID, nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	v, err := doc.LookupErr("_id")
+	if err != nil || v.Type == bsontype.Null {
+		return primitive.NilObjectID, doc, nil
+	}
+	key, ok := v.ObjectIDOK()
+	if ok && key.IsZero() {
+		return primitive.NilObjectID, nil, fmt.Errorf("%w: _id is zero", ErrInvalidDocument)
+	}
+	if !ok {
+		return primitive.NilObjectID, nil, fmt.Errorf("%w: _id is %s, not ObjectID", ErrInvalidDocument, v.Type)
+	}
+	return key, doc, nil
+}
+
+// Set 写入一条数据, 返回数据的key
+func (e *KvEngine) Set(data []byte) (primitive.ObjectID, error) {
+	req, err := newSetReq(data)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if e.overloaded() {
+		return primitive.NilObjectID, ErrOverloaded
+	}
+	if err := e.enqueue(req); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if err := <-req.done; err != nil {
+		return primitive.NilObjectID, err
+	}
+	return req.key, nil
+}
+
+// BatchSet 批量写入, 返回每条数据的key和结果, 和写入的顺序一一对应, 成功的错误为nil
+func (e *KvEngine) BatchSet(datas [][]byte) ([]primitive.ObjectID, []error) {
+	var keys = make([]primitive.ObjectID, len(datas))
+	var errs = make([]error, len(datas))
+	var reqs = make([]*setReq, len(datas))
+	var overloaded = e.overloaded()
+	for i, v := range datas {
+		req, err := newSetReq(v)
+		if err == nil && overloaded {
+			err = ErrOverloaded
+		}
+		if err == nil {
+			err = e.enqueue(req)
+		}
 		if err != nil {
-			log.Println(err)
+			errs[i] = err
+			continue
+		}
+		reqs[i] = req
+	}
+	for i, req := range reqs {
+		if req == nil {
 			continue
 		}
-		_id := doc.Lookup("_id").ObjectID()
-		if e.traceKey != "" {
-			trace := doc.Lookup(e.traceKey).String()
-			if trace != "" {
-				e.indexer.SetTrace(trace, _id)
+		if errs[i] = <-req.done; errs[i] == nil {
+			keys[i] = req.key
+		}
+	}
+	return keys, errs
+}
+
+// enqueue 队列满时最多等待 enqueueTimeout, 之后返回 ErrOverloaded 让客户端退避
+// 引擎关闭之后返回 ErrClosed
+func (e *KvEngine) enqueue(req *setReq) error {
+	e.chLock.RLock()
+	defer e.chLock.RUnlock()
+	if e.closed {
+		return ErrClosed
+	}
+	select {
+	case e.ch <- req:
+		return nil
+	default:
+	}
+	var timer = time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case e.ch <- req:
+		return nil
+	case <-timer.C:
+		return ErrOverloaded
+	}
+}
+
+// overloaded 缓存超过内存上限, 说明刷盘跟不上写入
+func (e *KvEngine) overloaded() bool {
+	return atomic.LoadInt64(&e.memBytes) >= e.meta.memLimit
+}
+
+func (e *KvEngine) receive() {
+	var tick <-chan time.Time
+	if e.meta.syncPolicy == SyncInterval {
+		var ticker = time.NewTicker(e.meta.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	defer close(e.done)
+
+	var pending []*setReq
+	for {
+		select {
+		case req, ok := <-e.ch:
+			if !ok {
+				e.commitWal(pending)
+				return
 			}
+			// 队列里已有的写入合并成一批
+			var batch = []*setReq{req}
+		drain:
+			for len(batch) < 1024 {
+				select {
+				case req, ok := <-e.ch:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, req)
+				default:
+					break drain
+				}
+			}
+			pending = append(pending, e.write(batch)...)
+			if e.meta.syncPolicy != SyncInterval {
+				pending = e.commitWal(pending)
+			}
+		case <-tick:
+			pending = e.commitWal(pending)
 		}
+	}
+}
 
-		e.cache.Set(_id, data)
+// write 把一批数据写入预写日志和缓存, 返回写入成功等待落盘的请求
+func (e *KvEngine) write(batch []*setReq) []*setReq {
+	var records = make([][]byte, 0, len(batch))
+	var accepted = make([]*setReq, 0, len(batch))
+	var size = atomic.LoadInt64(&e.memBytes)
+	var now = time.Now()
+	for _, req := range batch {
+		if size+int64(len(req.data)) > e.meta.memLimit {
+			req.done <- ErrOverloaded
+			continue
+		}
+		if req.key.IsZero() {
+			req.key = e.ids.next(now)
+			req.doc = withID(req.doc, req.key)
+			req.data = req.doc
+		}
+		size += int64(len(req.data))
+		records = append(records, req.data)
+		accepted = append(accepted, req)
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	e.Lock()
+	err := e.wal.write(records)
+	if err == nil {
+		var subs = e.subscribers()
+		for _, req := range accepted {
+			e.apply(req.key, req.doc, req.data)
+			req.subs = subs
+		}
+		skipReplay(subs, accepted)
+	}
+	e.Unlock()
+	if err != nil {
+		for _, req := range accepted {
+			req.done <- err
+		}
+		return nil
+	}
+	return accepted
+}
+
+// apply 写入缓存, 需要持有 e.Lock
+func (e *KvEngine) apply(_id primitive.ObjectID, doc bsoncore.Document, data []byte) {
+	for j, v := range e.indexValues(doc) {
+		if v != "" {
+			e.indexes[j].Set(v, _id)
+		}
+	}
+	if e.text != nil {
+		e.setText(indexEntry{key: _id, fields: e.textValues(doc)})
+	}
+	var delta = int64(len(data))
+	if old := e.cache.Get(_id); old != nil {
+		delta -= int64(len(old.Val().([]byte)))
+	}
+	e.cache.Set(_id, data)
+	if atomic.AddInt64(&e.memBytes, delta) >= e.meta.memLimit/4 {
+		e.kickFlush()
 	}
 }
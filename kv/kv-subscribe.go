@@ -0,0 +1,261 @@
+package kv
+
+import (
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrSlowSubscriber     = errors.New("subscriber too slow, resume from the last received key")
+	ErrSubscriptionClosed = errors.New("subscription closed")
+)
+
+// 订阅默认缓冲的新数据条数
+const defaultSubBuffer = 4096
+
+// SubscribeOptions 订阅参数, Filter 和 Trace 都为空时推送所有新数据
+type SubscribeOptions struct {
+	Filter *Filter
+	// 只推送这个链路下的数据, 需要开启链路索引
+	Trace string
+	// 不为空时先按key的顺序补发大于Resume的已有数据, 再推送新数据, 断线重连时传最后收到的key
+	Resume primitive.ObjectID
+	// 缓冲的新数据条数, 满了之后订阅以 ErrSlowSubscriber 结束, 不会阻塞写入
+	Buffer int
+}
+
+type subEntry struct {
+	key primitive.ObjectID
+	val []byte
+}
+
+// Subscription 写入协程接受的数据按接受的顺序推送给订阅者, 用法同 Iterator
+// 订阅之前已有的数据在补发阶段读出, 之后的数据走缓冲, 两边以订阅时的最大key为界
+type Subscription struct {
+	e     *KvEngine
+	match func(doc []byte) bool
+	ch    chan subEntry
+	done  chan struct{}
+	once  sync.Once
+	// done 关闭之前设置
+	err error
+
+	// 补发阶段的遍历, 补发完为nil, peek 为已经取出还没返回的一条
+	it   *Iterator
+	peek *subEntry
+
+	// 补发阶段在 (resume, bound] 内新写入的key, 会从缓冲推送, 遍历时跳过, 避免推送两次
+	// 写入协程持有 e.Lock 时加入, 补发结束后为nil
+	skipLock      sync.Mutex
+	resume, bound primitive.ObjectID
+	skip          map[primitive.ObjectID]struct{}
+
+	key primitive.ObjectID
+	val []byte
+}
+
+// Subscribe 订阅新写入的数据
+func (e *KvEngine) Subscribe(opts SubscribeOptions) (*Subscription, error) {
+	if opts.Trace != "" && e.traceKey == "" {
+		return nil, ErrNoTraceKey
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = defaultSubBuffer
+	}
+	var s = &Subscription{
+		e:    e,
+		ch:   make(chan subEntry, opts.Buffer),
+		done: make(chan struct{}),
+		match: func(doc []byte) bool {
+			if opts.Trace != "" && fieldValue(doc, e.traceKey) != opts.Trace {
+				return false
+			}
+			return opts.Filter == nil || opts.Filter.Match(doc)
+		},
+	}
+
+	// 注册和取当前最大key在同一把锁里, 之后接受的数据都会推送, 之前的都不超过bound
+	e.Lock()
+	var bound primitive.ObjectID
+	if node, ok := e.cache.Last(); ok {
+		bound = node.Key()
+	}
+	e.segLock.RLock()
+	for _, seg := range e.segments {
+		if _, max := seg.bounds(); compareKey(max, bound) > 0 {
+			bound = max
+		}
+	}
+	e.segLock.RUnlock()
+	if !opts.Resume.IsZero() {
+		if start, ok := NextKey(opts.Resume); ok {
+			s.it = e.NewIterator(start, bound, false)
+			s.resume, s.bound = opts.Resume, bound
+			s.skip = make(map[primitive.ObjectID]struct{})
+		}
+	}
+	if e.subs == nil {
+		e.subs = make(map[*Subscription]struct{})
+	}
+	e.subs[s] = struct{}{}
+	e.Unlock()
+	return s, nil
+}
+
+// Next 移动到下一条, 没有新数据时阻塞, 订阅结束后返回false
+func (s *Subscription) Next() bool {
+	if s.replay() {
+		s.key, s.val = s.peek.key, s.peek.val
+		s.peek = nil
+		return true
+	}
+	if s.it != nil {
+		return false
+	}
+	select {
+	case en := <-s.ch:
+		s.key, s.val = en.key, en.val
+		return true
+	case <-s.done:
+	}
+	// 结束之前已经进入缓冲的数据也要取完
+	select {
+	case en := <-s.ch:
+		s.key, s.val = en.key, en.val
+		return true
+	default:
+		return false
+	}
+}
+
+// replay 补发阶段取出下一条满足条件的数据放到peek, 补发完返回false
+// 遍历出错时订阅结束, it 保留不为nil
+func (s *Subscription) replay() bool {
+	if s.peek != nil {
+		return true
+	}
+	for s.it != nil {
+		if s.it.Next() {
+			if !s.skipped(s.it.Key()) && s.match(s.it.Value()) {
+				s.peek = &subEntry{key: s.it.Key(), val: s.it.Value()}
+				return true
+			}
+			continue
+		}
+		if err := s.it.Err(); err != nil {
+			s.stop(err)
+			return false
+		}
+		s.it = nil
+		s.skipLock.Lock()
+		s.skip = nil
+		s.skipLock.Unlock()
+	}
+	return false
+}
+
+func (s *Subscription) skipped(key primitive.ObjectID) bool {
+	s.skipLock.Lock()
+	defer s.skipLock.Unlock()
+	_, ok := s.skip[key]
+	return ok
+}
+
+// skipReplay 补发阶段写入的key由缓冲推送, 补发时不再读出, 需要持有 e.Lock
+// 遍历在这之前返回的是旧值, 之后返回时都会跳过, 新值只从缓冲推送一次; 落盘失败时新值不推送
+func skipReplay(subs []*Subscription, batch []*setReq) {
+	for _, s := range subs {
+		s.skipLock.Lock()
+		if s.skip != nil {
+			for _, req := range batch {
+				if compareKey(req.key, s.resume) > 0 && compareKey(req.key, s.bound) <= 0 {
+					s.skip[req.key] = struct{}{}
+				}
+			}
+		}
+		s.skipLock.Unlock()
+	}
+}
+
+// Ready 下一次 Next 是否不会阻塞, 用来把已有的数据攒成一批
+func (s *Subscription) Ready() bool {
+	return s.replay() || s.it != nil || len(s.ch) > 0
+}
+
+func (s *Subscription) Key() primitive.ObjectID {
+	return s.key
+}
+
+func (s *Subscription) Value() []byte {
+	return s.val
+}
+
+// Done 订阅结束时关闭
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err 订阅结束的原因, 调用 Close 结束时为 ErrSubscriptionClosed
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close 取消订阅, 可以在其他协程调用, 阻塞中的 Next 会返回
+func (s *Subscription) Close() {
+	s.stop(ErrSubscriptionClosed)
+}
+
+func (s *Subscription) stop(err error) {
+	s.once.Do(func() {
+		s.e.Lock()
+		delete(s.e.subs, s)
+		s.e.Unlock()
+		s.err = err
+		close(s.done)
+	})
+}
+
+// subscribers 当前的订阅, 需要持有 e.Lock
+func (e *KvEngine) subscribers() []*Subscription {
+	if len(e.subs) == 0 {
+		return nil
+	}
+	var subs = make([]*Subscription, 0, len(e.subs))
+	for s := range e.subs {
+		subs = append(subs, s)
+	}
+	return subs
+}
+
+// publish 推送已经落盘的写入, 只在写入协程里调用, 缓冲满的订阅直接结束
+func publish(batch []*setReq) {
+	for _, req := range batch {
+		for _, s := range req.subs {
+			if s.Err() != nil || !s.match(req.doc) {
+				continue
+			}
+			select {
+			case s.ch <- subEntry{key: req.key, val: req.data}:
+			default:
+				s.stop(ErrSlowSubscriber)
+			}
+		}
+	}
+}
+
+// closeSubscriptions 引擎关闭时结束所有订阅
+func (e *KvEngine) closeSubscriptions() {
+	e.Lock()
+	var subs = e.subscribers()
+	e.Unlock()
+	for _, s := range subs {
+		s.Close()
+	}
+}
@@ -0,0 +1,21 @@
+package kv
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNoTraceKey = errors.New("trace index not enabled")
+
+// Trace 按时间顺序返回链路下key不小于start的数据, 分页参数同 ScanRange, 不支持倒序
+func (e *KvEngine) Trace(trace string, start primitive.ObjectID, opts ScanOptions) ([][]byte, bool, error) {
+	if e.traceKey == "" {
+		return nil, false, ErrNoTraceKey
+	}
+	return e.lookup(func(start primitive.ObjectID, n int) []primitive.ObjectID {
+		return e.indexer.TracePage(trace, start, n)
+	}, start, opts, func(doc []byte) bool {
+		return fieldValue(doc, e.traceKey) == trace
+	})
+}
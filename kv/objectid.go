@@ -0,0 +1,70 @@
+package kv
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// idGen 给没有_id的文档分配ObjectID, 只在写入协程里使用
+// 格式和mongo一样: 4字节秒级时间戳 | 5字节随机数 | 3字节计数
+// 时间戳没有前进(同一秒内或者时钟回拨)时把后8字节当成大端整数加一
+// 这样同一个节点分配的key严格递增, 按key扫描就是写入的顺序
+type idGen struct {
+	last primitive.ObjectID
+	rand [5]byte
+}
+
+func newIDGen() *idGen {
+	var g = &idGen{}
+	if _, err := io.ReadFull(rand.Reader, g.rand[:]); err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g *idGen) next(now time.Time) primitive.ObjectID {
+	var id primitive.ObjectID
+	var ts = uint32(now.Unix())
+	if ts > binary.BigEndian.Uint32(g.last[0:4]) {
+		binary.BigEndian.PutUint32(id[0:4], ts)
+		copy(id[4:9], g.rand[:])
+	} else {
+		id = g.last
+		var tail = binary.BigEndian.Uint64(id[4:12]) + 1
+		if tail == 0 {
+			binary.BigEndian.PutUint32(id[0:4], binary.BigEndian.Uint32(id[0:4])+1)
+		}
+		binary.BigEndian.PutUint64(id[4:12], tail)
+	}
+	g.last = id
+	return id
+}
+
+// seed 重启后从已有的最大key继续, 保证和重启前分配的key也是递增的
+// 客户端写入的时间戳在未来的key不参与, 避免之后分配的key都跑到未来
+func (g *idGen) seed(key primitive.ObjectID, now time.Time) {
+	if key.Timestamp().After(now) || compareKey(key, g.last) <= 0 {
+		return
+	}
+	g.last = key
+}
+
+// withID 在文档最前面插入_id字段
+func withID(doc bsoncore.Document, id primitive.ObjectID) bsoncore.Document {
+	idx, dst := bsoncore.AppendDocumentStart(make([]byte, 0, len(doc)+len("_id")+14))
+	dst = bsoncore.AppendObjectIDElement(dst, "_id", id)
+	elems, _ := doc.Elements()
+	for _, elem := range elems {
+		if elem.Key() == "_id" {
+			continue
+		}
+		dst = append(dst, elem...)
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+	return dst
+}
@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var ErrInvalidProjection = errors.New("invalid projection")
+
+// Projection 只返回部分字段, 嵌套字段用点分隔, 数组里的文档逐个处理
+// include 时只保留列出的字段, _id 默认保留, 可以同时排除 _id; exclude 时去掉列出的字段
+type Projection struct {
+	include bool
+	// 是否保留 _id, 只在include时使用
+	id    bool
+	paths pathTree
+}
+
+// pathTree 字段路径组成的树, 叶子节点为nil表示整个字段
+type pathTree map[string]pathTree
+
+// NewProjection include 和 exclude 只能有一个, include 时 exclude 只能是 _id
+// 都为空时返回nil, 不做处理
+func NewProjection(include, exclude []string) (*Projection, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	var p = &Projection{include: len(include) > 0, id: true, paths: make(pathTree)}
+	var paths = exclude
+	if p.include {
+		for _, path := range exclude {
+			if path != "_id" {
+				return nil, fmt.Errorf("%w: cannot exclude %s when including fields", ErrInvalidProjection, path)
+			}
+			p.id = false
+		}
+		paths = include
+	}
+	for _, path := range paths {
+		if err := p.paths.add(path); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (t pathTree) add(path string) error {
+	var keys = strings.Split(path, ".")
+	for i, key := range keys {
+		if key == "" {
+			return fmt.Errorf("%w: bad path %q", ErrInvalidProjection, path)
+		}
+		sub, ok := t[key]
+		if ok && sub == nil {
+			// 已经包含了上层的整个字段
+			return nil
+		}
+		if i == len(keys)-1 {
+			t[key] = nil
+			return nil
+		}
+		if !ok {
+			sub = make(pathTree)
+			t[key] = sub
+		}
+		t = sub
+	}
+	return nil
+}
+
+// Apply 返回处理后的文档, p 为nil时返回原文档
+func (p *Projection) Apply(doc []byte) []byte {
+	if p == nil {
+		return doc
+	}
+	var paths = p.paths
+	if p.include && p.id {
+		if _, ok := paths["_id"]; !ok {
+			paths = make(pathTree, len(p.paths)+1)
+			for k, v := range p.paths {
+				paths[k] = v
+			}
+			paths["_id"] = nil
+		}
+	}
+	return project(bsoncore.Document(doc), paths, p.include)
+}
+
+func project(doc bsoncore.Document, paths pathTree, include bool) bsoncore.Document {
+	elems, err := doc.Elements()
+	if err != nil {
+		return doc
+	}
+	idx, dst := bsoncore.AppendDocumentStart(make([]byte, 0, len(doc)))
+	for _, el := range elems {
+		sub, ok := paths[el.Key()]
+		switch {
+		case !ok:
+			if !include {
+				dst = append(dst, el...)
+			}
+		case sub == nil:
+			if include {
+				dst = append(dst, el...)
+			}
+		default:
+			dst = appendNested(dst, el, sub, include)
+		}
+	}
+	dst, _ = bsoncore.AppendDocumentEnd(dst, idx)
+	return dst
+}
+
+// appendNested 对子文档或者数组里的文档继续处理, 其他类型的值 include 时去掉, exclude 时保留
+func appendNested(dst []byte, el bsoncore.Element, paths pathTree, include bool) []byte {
+	var v = el.Value()
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		return bsoncore.AppendDocumentElement(dst, el.Key(), project(v.Document(), paths, include))
+	case bsontype.Array:
+		vals, err := v.Array().Values()
+		if err != nil {
+			return dst
+		}
+		idx, arr := bsoncore.AppendArrayStart(nil)
+		var n = 0
+		for _, val := range vals {
+			if doc, ok := val.DocumentOK(); ok {
+				arr = bsoncore.AppendDocumentElement(arr, strconv.Itoa(n), project(doc, paths, include))
+				n++
+			} else if !include {
+				arr = bsoncore.AppendValueElement(arr, strconv.Itoa(n), val)
+				n++
+			}
+		}
+		arr, _ = bsoncore.AppendArrayEnd(arr, idx)
+		return bsoncore.AppendArrayElement(dst, el.Key(), arr)
+	}
+	if include {
+		return dst
+	}
+	return append(dst, el...)
+}
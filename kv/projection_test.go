@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 嵌套字段和数组里的文档, include 和 exclude 各自的结果
+func TestProjection(t *testing.T) {
+	var id = primitive.NewObjectID()
+	var ctx = bson.M{"user": "u1", "ip": "10.0.0.1", "geo": bson.M{"city": "sh", "lat": 31.2}}
+	doc, _ := bson.Marshal(bson.M{
+		"_id":   id,
+		"app":   "checkout",
+		"ctx":   ctx,
+		"spans": bson.A{bson.M{"name": "db", "ms": 12}, bson.M{"name": "cache", "ms": 1}, "raw"},
+		"tags":  bson.A{"a", "b"},
+	})
+	var cases = []struct {
+		name             string
+		include, exclude []string
+		want             bson.M
+	}{
+		{"include top", []string{"app"}, nil, bson.M{"_id": id, "app": "checkout"}},
+		{"include without id", []string{"app"}, []string{"_id"}, bson.M{"app": "checkout"}},
+		{"include nested", []string{"ctx.user", "ctx.geo.city"}, nil, bson.M{
+			"_id": id,
+			"ctx": bson.M{"user": "u1", "geo": bson.M{"city": "sh"}},
+		}},
+		{"include parent and child", []string{"ctx", "ctx.user"}, []string{"_id"}, bson.M{"ctx": ctx}},
+		{"include array of docs", []string{"spans.name"}, []string{"_id"}, bson.M{
+			"spans": bson.A{bson.M{"name": "db"}, bson.M{"name": "cache"}},
+		}},
+		{"include into scalar", []string{"app.x", "tags.x"}, []string{"_id"}, bson.M{"tags": bson.A{}}},
+		{"include missing", []string{"missing"}, nil, bson.M{"_id": id}},
+		{"exclude top", nil, []string{"spans", "tags", "_id"}, bson.M{"app": "checkout", "ctx": ctx}},
+		{"exclude nested", nil, []string{"ctx.ip", "ctx.geo", "spans", "tags"}, bson.M{
+			"_id": id,
+			"app": "checkout",
+			"ctx": bson.M{"user": "u1"},
+		}},
+		{"exclude array of docs", nil, []string{"spans.ms", "ctx", "_id", "app"}, bson.M{
+			"spans": bson.A{bson.M{"name": "db"}, bson.M{"name": "cache"}, "raw"},
+			"tags":  bson.A{"a", "b"},
+		}},
+	}
+	for _, c := range cases {
+		p, err := NewProjection(c.include, c.exclude)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var got, want bson.M
+		if err := bson.Unmarshal(p.Apply(doc), &got); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		data, _ := bson.Marshal(c.want)
+		bson.Unmarshal(data, &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", c.name, got, want)
+		}
+	}
+
+	if p, err := NewProjection(nil, nil); p != nil || err != nil || !reflect.DeepEqual(p.Apply(doc), doc) {
+		t.Fatalf("empty projection: %v", err)
+	}
+	var invalid = []struct{ include, exclude []string }{
+		{[]string{"app"}, []string{"ctx"}},
+		{[]string{"ctx..user"}, nil},
+		{nil, []string{""}},
+		{[]string{"ctx."}, nil},
+	}
+	for _, c := range invalid {
+		if _, err := NewProjection(c.include, c.exclude); !errors.Is(err, ErrInvalidProjection) {
+			t.Fatalf("%v %v: expect ErrInvalidProjection, got %v", c.include, c.exclude, err)
+		}
+	}
+}
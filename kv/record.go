@@ -0,0 +1,141 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	bytesutils "logkv/bytes-utils"
+	"os"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+var (
+	ErrCorrupt = errors.New("corrupt record")
+)
+
+const (
+	// 记录头: 4字节数据长度 + 4字节crc32
+	recordHeaderSize = 8
+	// bson文档的上限是16M, 一个块最多比最大的文档多一个块大小, 超过的长度一定是坏数据
+	maxRecordSize = 32 * 1024 * 1024
+	maxDocSize    = 16 * 1024 * 1024
+	// 块大小的上限, 留出最大的文档和压缩, 加密的开销, 保证写出的块都能读回来
+	maxBlockSize = maxRecordSize - maxDocSize - 1024*1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecord 给数据加上长度和校验和
+func encodeRecord(data []byte) []byte {
+	var buf = make([]byte, recordHeaderSize+len(data))
+	copy(buf[0:4], bytesutils.UintToBytes(uint64(len(data)), 4))
+	copy(buf[4:8], bytesutils.UintToBytes(uint64(crc32.Checksum(data, crcTable)), 4))
+	copy(buf[recordHeaderSize:], data)
+	return buf
+}
+
+// readRecord 读取一条记录, 返回读取的字节数和数据
+// 数据不完整返回 io.ErrUnexpectedEOF, 校验失败返回 ErrCorrupt
+func readRecord(r io.Reader) (int, []byte, error) {
+	var header = make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil {
+		return n, nil, err
+	}
+	size, _ := bytesutils.BytesToIntU(header[0:4])
+	sum, _ := bytesutils.BytesToIntU(header[4:8])
+	if size < 5 || size > maxRecordSize {
+		return n, nil, ErrCorrupt
+	}
+	var data = make([]byte, size)
+	n1, err := io.ReadFull(r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n + n1, nil, err
+	}
+	if crc32.Checksum(data, crcTable) != uint32(sum) {
+		return n + n1, nil, ErrCorrupt
+	}
+	return n + n1, data, nil
+}
+
+// countRecords 粗略统计损坏的尾部里还能分辨出的记录数, 至少算一条
+// 完好的块按块内文档数算, 损坏的块算一条
+func countRecords(r io.Reader, sl *sealer) int {
+	var count = 0
+	for {
+		n, body, err := readBlock(r, sl)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			eachBlockDoc(body, func(int32, bsoncore.Document) bool {
+				count++
+				return true
+			})
+		} else if n > 0 {
+			count++
+		}
+		if (err != nil && err != ErrCorrupt) || n <= recordHeaderSize {
+			break
+		}
+	}
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
+func isTornRecord(err error) bool {
+	return err == ErrCorrupt || err == io.ErrUnexpectedEOF
+}
+
+// 段文件和预写日志的文件头: magic | 版本 | 密钥编号 | 保留
+const fileHeaderSize = 16
+
+const fileVersion = 1
+
+var fileMagic = []byte("LKVF")
+
+var (
+	ErrBadHeader = errors.New("bad file header")
+)
+
+func encodeFileHeader(keyID uint32) []byte {
+	var buf = make([]byte, fileHeaderSize)
+	copy(buf[0:4], fileMagic)
+	buf[4] = fileVersion
+	copy(buf[5:9], bytesutils.UintToBytes(uint64(keyID), 4))
+	return buf
+}
+
+// initFileHeader 新文件写入文件头, 已有的文件读出密钥编号
+// 文件头没写完整说明文件里还没有数据, 重写文件头
+func initFileHeader(fd *os.File, size int64, keyID uint32) (uint32, int64, error) {
+	if size > 0 && size < fileHeaderSize {
+		if err := fd.Truncate(0); err != nil {
+			return 0, 0, err
+		}
+		size = 0
+	}
+	if size == 0 {
+		if _, err := fd.Write(encodeFileHeader(keyID)); err != nil {
+			return 0, 0, err
+		}
+		return keyID, fileHeaderSize, nil
+	}
+	var buf = make([]byte, fileHeaderSize)
+	if _, err := fd.ReadAt(buf, 0); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(buf[0:4], fileMagic) || buf[4] != fileVersion {
+		return 0, 0, fmt.Errorf("%s: %w", fd.Name(), ErrBadHeader)
+	}
+	id, _ := bytesutils.BytesToIntU(buf[5:9])
+	return uint32(id), size, nil
+}
@@ -0,0 +1,140 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"log"
+	bytesutils "logkv/bytes-utils"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// RecoverInfo 启动时发现的损坏或者写了一半的数据
+// Tail 为true时是尾部, 段文件从 Offset 截断; 否则是中间损坏的块, 用填充块覆盖, 之后的数据保留
+type RecoverInfo struct {
+	Segment    int64
+	Offset     int64
+	Bytes      int64
+	Records    int
+	Tail       bool
+	Quarantine string
+}
+
+// recoverCorrupt 处理段文件中offset处读不出来的记录
+// 之后还有完好的记录时只跳过损坏的部分, 否则是写了一半的尾部, 截断
+func recoverCorrupt(seg *segment, offset int64) (RecoverInfo, error) {
+	next, err := nextRecord(seg, offset+minPadRecord(seg.sealer))
+	if err != nil {
+		return RecoverInfo{Segment: seg.id, Offset: offset}, err
+	}
+	if next < 0 {
+		return recoverSegment(seg, offset)
+	}
+	return skipCorrupt(seg, offset, next)
+}
+
+// recoverSegment 把offset之后损坏的数据移到隔离文件, 然后截断段文件
+func recoverSegment(seg *segment, offset int64) (RecoverInfo, error) {
+	info, err := quarantine(seg, offset, seg.size-offset)
+	if err != nil {
+		return info, err
+	}
+	info.Tail = true
+
+	if err := seg.fd.Truncate(offset); err != nil {
+		return info, err
+	}
+	if err := seg.fd.Sync(); err != nil {
+		return info, err
+	}
+	seg.size = offset
+	log.Printf("segment %d: truncated %d bytes at offset %d, lost %d records, quarantined to %s",
+		info.Segment, info.Bytes, info.Offset, info.Records, info.Quarantine)
+	return info, nil
+}
+
+// skipCorrupt 把 [offset, next) 之间损坏的数据复制到隔离文件, 原位置写一个同样长度的填充块
+// 填充块里的文档没有 _id, 顺序读取时跳过, 之后的块偏移不变
+func skipCorrupt(seg *segment, offset, next int64) (RecoverInfo, error) {
+	info, err := quarantine(seg, offset, next-offset)
+	if err != nil {
+		return info, err
+	}
+	// 段文件用追加模式打开, 不能按偏移写
+	fd, err := os.OpenFile(seg.fd.Name(), os.O_WRONLY, 0)
+	if err != nil {
+		return info, err
+	}
+	defer fd.Close()
+	if _, err := fd.WriteAt(padRecord(seg.sealer, int(info.Bytes)), offset); err != nil {
+		return info, err
+	}
+	if err := fd.Sync(); err != nil {
+		return info, err
+	}
+	log.Printf("segment %d: skipped %d corrupt bytes at offset %d, lost %d records, quarantined to %s",
+		info.Segment, info.Bytes, info.Offset, info.Records, info.Quarantine)
+	return info, nil
+}
+
+// quarantine 把段文件中 [offset, offset+size) 的数据复制到隔离文件
+func quarantine(seg *segment, offset, size int64) (RecoverInfo, error) {
+	var info = RecoverInfo{
+		Segment:    seg.id,
+		Offset:     offset,
+		Bytes:      size,
+		Quarantine: fmt.Sprintf("%s.corrupt.%d.%d", seg.fd.Name(), offset, time.Now().Unix()),
+	}
+	info.Records = countRecords(io.NewSectionReader(seg.fd, offset, size), seg.sealer)
+
+	f, err := os.Create(info.Quarantine)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, io.NewSectionReader(seg.fd, offset, size)); err != nil {
+		return info, err
+	}
+	return info, f.Sync()
+}
+
+// nextRecord 从offset开始逐字节查找下一条完好的记录, 没有时返回-1
+// 先检查长度再读整条记录, 随机数据里很少有长度合法的位置
+func nextRecord(seg *segment, offset int64) (int64, error) {
+	var header = make([]byte, recordHeaderSize)
+	for ; offset+recordHeaderSize < seg.size; offset++ {
+		if _, err := seg.fd.ReadAt(header, offset); err != nil {
+			return -1, err
+		}
+		size, _ := bytesutils.BytesToIntU(header[0:4])
+		if size < 5 || size > maxRecordSize || offset+recordHeaderSize+int64(size) > seg.size {
+			continue
+		}
+		if _, _, err := readBlock(io.NewSectionReader(seg.fd, offset, seg.size-offset), seg.sealer); err == nil {
+			return offset, nil
+		}
+	}
+	return -1, nil
+}
+
+// padRecord 生成正好size字节的填充块, 块里是一个只有二进制字段 pad 的文档
+// size 不能小于 minPadRecord, 完好的块至少有一个带 _id 的文档, 不会比它小
+func padRecord(sl *sealer, size int) []byte {
+	var n = size - int(minPadRecord(sl))
+	var doc = bsoncore.BuildDocument(nil, bsoncore.AppendBinaryElement(nil, "pad", 0, make([]byte, n)))
+	payload, _ := encodeBlock(CompressNone, doc)
+	return encodeRecord(sl.seal(payload))
+}
+
+// minPadRecord pad 字段为空时填充块的大小
+// 文档: 长度4 + 类型1 + "pad\0" 4 + 长度4 + 子类型1 + 结束1
+func minPadRecord(sl *sealer) int64 {
+	return int64(recordHeaderSize + sl.overhead() + 1 + 15)
+}
+
+// Recovered 返回启动时截断的尾部和跳过的损坏块
+func (e *KvEngine) Recovered() []RecoverInfo {
+	return e.recovered
+}
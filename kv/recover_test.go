@@ -0,0 +1,142 @@
+package kv
+
+import (
+	"errors"
+	"io/ioutil"
+	bytesutils "logkv/bytes-utils"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 段文件尾部写了一半或者损坏, 启动时从第一条坏记录截断, 之后的数据移到隔离文件
+// 中间的块损坏时只跳过这个块, 之后的块保留
+// 每个文档单独一个块, 删除索引文件让启动时扫描整个段
+func TestRecoverCorrupt(t *testing.T) {
+	const docs = 30
+	var cases = []struct {
+		name string
+		// 追加到段文件末尾的数据
+		tail []byte
+		// 破坏第几个块, -1不破坏
+		flip int
+		// 是否截断, 丢掉的记录数
+		truncate bool
+		records  int
+		// 加密和压缩后填充块的大小也要正好
+		keys string
+	}{
+		{"torn header", []byte{1, 2, 3, 4, 5}, -1, true, 1, ""},
+		{"torn body", append(append(bytesutils.UintToBytes(100, 4), 0, 0, 0, 0), make([]byte, 10)...), -1, true, 1, ""},
+		{"corrupt last block", nil, docs - 1, true, 1, ""},
+		{"corrupt middle block", nil, 20, false, 1, ""},
+		{"corrupt first block", nil, 0, false, 1, ""},
+		{"corrupt encrypted block", nil, 10, false, 1, "1:000102030405060708090a0b0c0d0e0f"},
+	}
+	for _, c := range cases {
+		var opts = []Option{WithCompression(CompressNone, 1), WithSyncPolicy(SyncNone, 0)}
+		if c.keys != "" {
+			keys, err := LoadKeyring(c.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts = append(opts, WithKeyring(keys), WithCompression(CompressSnappy, 1))
+		}
+		var e = newTestEngine(t, opts...)
+		defer e.cleanup()
+		var keys []primitive.ObjectID
+		var offsets []int64
+		for i := 0; i < docs; i++ {
+			data, _ := bson.Marshal(bson.M{"_id": primitive.NewObjectID(), "i": i})
+			if _, err := e.Set(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+			pos, ok := e.indexer.Get(DocKey(data))
+			if !ok {
+				t.Fatalf("%s: doc %d not flushed", c.name, i)
+			}
+			keys = append(keys, DocKey(data))
+			offsets = append(offsets, pos.Offset)
+		}
+		var segID = e.Head().Segment
+		e.stop()
+
+		var name = segmentName(e.dirname, segID)
+		raw, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var size = int64(len(raw))
+		var offset, bad = size, size
+		if c.flip >= 0 {
+			offset = offsets[c.flip]
+			raw[offset+recordHeaderSize+2] ^= 0xff
+			if c.flip+1 < docs {
+				bad = offsets[c.flip+1]
+			}
+		}
+		raw = append(raw, c.tail...)
+		if c.truncate {
+			bad = int64(len(raw))
+		}
+		if err := ioutil.WriteFile(name, raw, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(indexName(e.dirname, segID))
+
+		e.open()
+		var recovered = e.Recovered()
+		if len(recovered) != 1 {
+			t.Fatalf("%s: recovered %d, want 1", c.name, len(recovered))
+		}
+		var info = recovered[0]
+		if info.Segment != segID || info.Offset != offset || info.Bytes != bad-offset || info.Records != c.records || info.Tail != c.truncate {
+			t.Fatalf("%s: recovered %+v, want offset %d bytes %d records %d", c.name, info, offset, bad-offset, c.records)
+		}
+		if q, err := os.Stat(info.Quarantine); err != nil || q.Size() != info.Bytes {
+			t.Fatalf("%s: quarantine file: %v", c.name, err)
+		}
+		var length = int64(len(raw))
+		if c.truncate {
+			length = offset
+		}
+		if s, err := os.Stat(name); err != nil || s.Size() != length {
+			t.Fatalf("%s: segment size want %d: %v", c.name, length, err)
+		}
+
+		// 损坏的文档读不到, 其他的都在, 变更流里也只少这一条
+		for i, key := range keys {
+			var lost = c.flip == i
+			if _, err := e.Get(key); lost != errors.Is(err, ErrNotFound) || (!lost && err != nil) {
+				t.Fatalf("%s: get doc %d: %v", c.name, i, err)
+			}
+		}
+		var survive = docs
+		if c.flip >= 0 {
+			survive--
+		}
+		changes, _, err := e.Changes(Position{}, 100, 0)
+		if err != nil || len(changes) != survive {
+			t.Fatalf("%s: %d changes, want %d: %v", c.name, len(changes), survive, err)
+		}
+
+		// 再次启动不会重复处理
+		e.restart()
+		if len(e.Recovered()) != 0 {
+			t.Fatalf("%s: recovered again %+v", c.name, e.Recovered())
+		}
+		var n int
+		var it = e.NewIterator(primitive.NilObjectID, MaxKey, false)
+		for it.Next() {
+			n++
+		}
+		if it.Err() != nil || n != survive {
+			t.Fatalf("%s: %d docs left, want %d: %v", c.name, n, survive, it.Err())
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package kv
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RetentionStat 当前的保留策略和保留的数据
+type RetentionStat struct {
+	Oldest   time.Time
+	MaxAge   time.Duration
+	MaxSize  int64
+	Segments int
+	Size     int64
+}
+
+func (e *KvEngine) retentionTick(ctx context.Context) {
+	if e.meta.retentionAge <= 0 && e.meta.retentionSize <= 0 {
+		return
+	}
+	var ticker = time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.enforceRetention(time.Now()); err != nil {
+				log.Println(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// enforceRetention 删除超过保留时间的段, 以及总大小超过上限时最老的段
+// 开启了 consumerRetention 时, 消费者还没读完的段和之后的段都保留
+func (e *KvEngine) enforceRetention(now time.Time) error {
+	var deadline = primitive.NewObjectIDFromTimestamp(now.Add(-e.meta.retentionAge))
+	n, err := e.dropSegments(func(seg *segment, remain int64) bool {
+		if e.retainedByConsumer(seg) {
+			return false
+		}
+		if e.meta.retentionSize > 0 && remain > e.meta.retentionSize {
+			return true
+		}
+		if e.meta.retentionAge > 0 {
+			_, max := seg.bounds()
+			return compareKey(max, deadline) < 0
+		}
+		return false
+	})
+	if n > 0 {
+		log.Printf("retention: drop %d segments", n)
+	}
+	return err
+}
+
+// Oldest 返回当前保留的最早一条数据的时间
+func (e *KvEngine) Oldest() (time.Time, bool) {
+	e.segLock.RLock()
+	for _, seg := range e.segments {
+		if min, _ := seg.bounds(); !min.IsZero() {
+			e.segLock.RUnlock()
+			return min.Timestamp(), true
+		}
+	}
+	e.segLock.RUnlock()
+
+	e.Lock()
+	defer e.Unlock()
+	if node, ok := e.cache.First(); ok {
+		return node.Key().Timestamp(), true
+	}
+	return time.Time{}, false
+}
+
+func (e *KvEngine) Retention() RetentionStat {
+	var stat = RetentionStat{
+		MaxAge:  e.meta.retentionAge,
+		MaxSize: e.meta.retentionSize,
+	}
+	stat.Oldest, _ = e.Oldest()
+	e.segLock.RLock()
+	defer e.segLock.RUnlock()
+	stat.Segments = len(e.segments)
+	for _, seg := range e.segments {
+		stat.Size += seg.length()
+	}
+	return stat
+}
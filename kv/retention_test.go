@@ -0,0 +1,144 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 按时间和总大小整段删除最老的段, 删除后以及重启后链路索引, 扫描和变更流都只剩保留的数据
+// 段大小设成1让每个块单独一个段, 每批数据的时间相差一小时, 一个段里只有同一批的数据
+func TestRetention(t *testing.T) {
+	const batches, perBatch = 5, 40
+	var cases = []struct {
+		name string
+		age  time.Duration
+		size int64
+		// 按时间删除时保留的批数, 按大小删除时由段的大小决定
+		keep int
+	}{
+		{"age", 90 * time.Minute, 0, 2},
+		{"size", 0, 6 * 1024, 0},
+	}
+	for _, c := range cases {
+		var e = newTestEngine(t, WithSegmentSize(1), WithCompression(CompressNone, 1024), WithSyncPolicy(SyncNone, 0),
+			WithTraceKey("trace"), WithRetention(c.age, c.size))
+		defer e.cleanup()
+
+		var now = time.Now()
+		var keys []primitive.ObjectID
+		var traces = map[primitive.ObjectID]string{}
+		for b := 0; b < batches; b++ {
+			var base = primitive.NewObjectIDFromTimestamp(now.Add(time.Duration(b-batches+1) * time.Hour))
+			for i := 0; i < perBatch; i++ {
+				var key = base
+				key[10], key[11] = byte(i>>8), byte(i)
+				var trace = fmt.Sprintf("t%d", i%3)
+				data, _ := bson.Marshal(bson.M{"_id": key, "trace": trace, "msg": "hello logkv"})
+				if _, err := e.Set(data); err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+				traces[key] = trace
+			}
+			if err := e.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		e.segLock.RLock()
+		var segments = append([]*segment(nil), e.segments...)
+		e.segLock.RUnlock()
+		var first = e.firstPosition()
+		if err := e.enforceRetention(now); err != nil {
+			t.Fatal(err)
+		}
+		var stat = e.Retention()
+		var dropped = len(segments) - stat.Segments
+		if dropped <= 0 || stat.Segments < 2 {
+			t.Fatalf("%s: dropped %d of %d segments", c.name, dropped, len(segments))
+		}
+		for i, seg := range segments {
+			if _, err := os.Stat(segmentName(e.dirname, seg.id)); os.IsNotExist(err) != (i < dropped) {
+				t.Fatalf("%s: segment %d file exists %v, dropped %d", c.name, seg.id, err == nil, dropped)
+			}
+		}
+		if c.size > 0 {
+			// 只删到总大小不超过上限为止
+			var remain = segments[dropped-1].length()
+			for _, seg := range segments[dropped:] {
+				remain += seg.length()
+			}
+			if stat.Size > c.size || remain <= c.size {
+				t.Fatalf("%s: %d bytes left, %d before the last drop, limit %d", c.name, stat.Size, remain, c.size)
+			}
+		}
+
+		// 保留的是按key顺序的一段后缀, 第一个保留的key之前的都读不到
+		var survive []primitive.ObjectID
+		for _, key := range keys {
+			if _, err := e.Get(key); err == nil {
+				survive = append(survive, key)
+			} else if !errors.Is(err, ErrNotFound) {
+				t.Fatal(err)
+			}
+		}
+		if c.keep > 0 && len(survive) != c.keep*perBatch {
+			t.Fatalf("%s: %d docs left, want %d", c.name, len(survive), c.keep*perBatch)
+		}
+		if len(survive) == 0 || survive[0] != keys[len(keys)-len(survive)] {
+			t.Fatalf("%s: %d docs left are not the newest", c.name, len(survive))
+		}
+		if _, _, err := e.Changes(first, 10, 0); err != ErrOffsetExpired {
+			t.Fatalf("%s: read dropped segment: %v", c.name, err)
+		}
+
+		for restart := 0; restart < 2; restart++ {
+			var check = func(what string, datas [][]byte, want []primitive.ObjectID) {
+				if len(datas) != len(want) {
+					t.Fatalf("%s restart %d: %s got %d docs, want %d", c.name, restart, what, len(datas), len(want))
+				}
+				for i, data := range datas {
+					if DocKey(data) != want[i] {
+						t.Fatalf("%s restart %d: %s doc %d is %s, want %s", c.name, restart, what, i, DocKey(data).Hex(), want[i].Hex())
+					}
+				}
+			}
+			datas, err := e.Scan(primitive.NilObjectID, MaxKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("scan", datas, survive)
+
+			changes, _, err := e.Changes(Position{}, 1000, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			datas = datas[:0]
+			for _, ch := range changes {
+				datas = append(datas, ch.Data)
+			}
+			check("changes", datas, survive)
+
+			for _, trace := range []string{"t0", "t1", "t2"} {
+				var want []primitive.ObjectID
+				for _, key := range survive {
+					if traces[key] == trace {
+						want = append(want, key)
+					}
+				}
+				datas, _, err := e.Trace(trace, primitive.NilObjectID, ScanOptions{Limit: 1000})
+				if err != nil {
+					t.Fatal(err)
+				}
+				check("trace "+trace, datas, want)
+			}
+			e.restart()
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package kv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const segmentExt = ".kv"
+
+// segment 一个按编号递增的数据文件, 写满或者跨过时间边界后滚动到下一个
+type segment struct {
+	sync.RWMutex
+	id      int64
+	fd      *os.File
+	size    int64
+	created time.Time
+
+	// 按文件头里的密钥加解密块
+	sealer *sealer
+
+	// 段内最小/最大的key, 用于按时间整段删除
+	min, max primitive.ObjectID
+}
+
+func segmentName(dirname string, id int64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func openSegment(dirname string, id int64, keys *Keyring) (*segment, error) {
+	fd, err := os.OpenFile(segmentName(dirname, id), os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend|os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	keyID, size, err := initFileHeader(fd, info.Size(), keys.activeID())
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	sl, err := keys.sealer(keyID)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("segment %d: %w", id, err)
+	}
+	return &segment{
+		id:      id,
+		fd:      fd,
+		size:    size,
+		created: time.Now(),
+		sealer:  sl,
+	}, nil
+}
+
+// listFiles 返回目录下某种扩展名的所有文件编号, 从小到大
+func listFiles(dirname string, ext string) ([]int64, error) {
+	infos, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	var ids = make([]int64, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// writeFileAtomic 先写临时文件并fsync, 再改名覆盖, 然后fsync目录让改名落盘
+// 中间崩溃时读到的要么是旧文件, 要么是完整的新文件
+func writeFileAtomic(name string, write func(w io.Writer) error) error {
+	var tmp = name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var w = bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// append 追加一个块, 返回块的偏移
+func (s *segment) append(keys []primitive.ObjectID, payload []byte) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	var offset = s.size
+	n, err := s.fd.Write(encodeRecord(s.sealer.seal(payload)))
+	if err != nil {
+		// 写了一半的块要截掉, 否则后续的偏移都不对
+		s.fd.Truncate(s.size)
+		return offset, err
+	}
+	s.size += int64(n)
+	for _, key := range keys {
+		s.track(key)
+	}
+	return offset, nil
+}
+
+// read 按偏移读取并解压一个块, 不移动文件游标, 可以和写入并发
+func (s *segment) read(offset int64) ([]byte, error) {
+	_, body, err := s.readAt(offset)
+	return body, err
+}
+
+// readAt 同 read, 同时返回块在文件里占的字节数, 用来顺序读取
+func (s *segment) readAt(offset int64) (int, []byte, error) {
+	var size = s.length()
+	if offset >= size {
+		return 0, nil, ErrNotFound
+	}
+	return readBlock(io.NewSectionReader(s.fd, offset, size-offset), s.sealer)
+}
+
+func (s *segment) length() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.size
+}
+
+func (s *segment) bounds() (primitive.ObjectID, primitive.ObjectID) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.min, s.max
+}
+
+// track 记录写入段中的key
+func (s *segment) track(key primitive.ObjectID) {
+	if s.min.IsZero() || compareKey(key, s.min) < 0 {
+		s.min = key
+	}
+	if compareKey(key, s.max) > 0 {
+		s.max = key
+	}
+}
+
+// shouldRoll 段大小超过上限, 跨过了滚动的时间边界, 或者段的密钥不是当前使用的密钥
+func (s *segment) shouldRoll(meta *EngineMeta, now time.Time) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if s.sealer.keyID() != meta.keys.activeID() {
+		return true
+	}
+	if s.size <= fileHeaderSize {
+		return false
+	}
+	if meta.segmentSize > 0 && s.size >= meta.segmentSize {
+		return true
+	}
+	if meta.rollInterval > 0 && now.Truncate(meta.rollInterval).After(s.created.Truncate(meta.rollInterval)) {
+		return true
+	}
+	return false
+}
+
+func (s *segment) close() error {
+	return s.fd.Close()
+}
+
+func (s *segment) remove() error {
+	s.fd.Close()
+	var name = s.fd.Name()
+	for _, ext := range []string{indexExt, textExt} {
+		if err := os.Remove(strings.TrimSuffix(name, segmentExt) + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(name)
+}
+
+func compareKey(a, b primitive.ObjectID) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// 全文索引文件和索引文件的格式相同, 每个全文字段的值为文档里去重后的词, 用空格连接
+// 文件不存在或者字段变化时从段文件重建
+const textExt = ".fts"
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+func textName(dirname string, id int64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%020d%s", id, textExt))
+}
+
+// tokenize 按字母和数字切词并转成小写, 汉字, 假名, 谚文这样不用空格分词的文字每个字是一个词
+func tokenize(s string) []string {
+	var tokens []string
+	var b strings.Builder
+	var flush = func() {
+		if b.Len() > 0 {
+			tokens = append(tokens, b.String())
+			b.Reset()
+		}
+	}
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// textTokens 每个全文字段切出来的词, 只索引字符串字段
+func textTokens(doc bsoncore.Document, paths []string) [][]string {
+	var tokens = make([][]string, len(paths))
+	for i, path := range paths {
+		v, err := doc.LookupErr(strings.Split(path, ".")...)
+		if err == nil && v.Type == bsontype.String {
+			tokens[i] = tokenize(v.StringValue())
+		}
+	}
+	return tokens
+}
+
+// textTerms 每个全文字段去重后的词, 用空格连接
+func textTerms(doc bsoncore.Document, paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	var values = make([]string, len(paths))
+	for i, tokens := range textTokens(doc, paths) {
+		var seen = make(map[string]struct{}, len(tokens))
+		var terms = make([]string, 0, len(tokens))
+		for _, token := range tokens {
+			if _, ok := seen[token]; !ok {
+				seen[token] = struct{}{}
+				terms = append(terms, token)
+			}
+		}
+		values[i] = strings.Join(terms, " ")
+	}
+	return values
+}
+
+// Query 全文查询, 多组之间为 OR, 组内的每一项都要匹配
+// 一项只有一个词时包含这个词即可, 多个词时为短语, 要在同一个字段里连续出现
+type Query struct {
+	groups [][][]string
+}
+
+// ParseQuery 解析查询, 例如 `timeout "connection reset" OR panic`
+// 空格分隔的项为 AND, 大写的 OR 分隔组, 引号内为短语, 大写的 AND 可以省略
+// 一个词切出多个词时按短语处理, 例如 "连接超时"
+func ParseQuery(s string) (*Query, error) {
+	var q = &Query{}
+	var group [][]string
+	var endGroup = func() error {
+		if len(group) == 0 {
+			return fmt.Errorf("%w: empty clause in %q", ErrInvalidQuery, s)
+		}
+		q.groups = append(q.groups, group)
+		group = nil
+		return nil
+	}
+	for s := strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		var word string
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unclosed quote", ErrInvalidQuery)
+			}
+			word, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			word, s = s[:end], s[end:]
+			if word == "OR" {
+				if err := endGroup(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if word == "AND" {
+				continue
+			}
+		}
+		if tokens := tokenize(word); len(tokens) > 0 {
+			group = append(group, tokens)
+		}
+	}
+	if err := endGroup(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// page 不小于start且不大于end的最多n个可能匹配的key, 按key排序
+// 短语的每个词都出现过即可, 读取文档后再用 match 确认
+// 每组只取前n个, 合并之后的前n个一定在里面
+func (q *Query) page(idx *Index, start, end primitive.ObjectID, n int) []primitive.ObjectID {
+	var keys []primitive.ObjectID
+	for _, group := range q.groups {
+		var terms []string
+		for _, item := range group {
+			terms = append(terms, item...)
+		}
+		keys = append(keys, idx.Intersect(terms, start, end, n)...)
+	}
+	if len(q.groups) > 1 {
+		keys = sortKeys(keys)
+		if len(keys) > n {
+			keys = keys[:n]
+		}
+	}
+	return keys
+}
+
+// exact 没有短语时索引查到的key就是结果, 不用读取文档确认
+func (q *Query) exact() bool {
+	for _, group := range q.groups {
+		for _, item := range group {
+			if len(item) > 1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// match texts 为每个全文字段切出来的词
+func (q *Query) match(texts [][]string) bool {
+	for _, group := range q.groups {
+		var ok = true
+		for _, item := range group {
+			if !containsPhrase(texts, item) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPhrase(texts [][]string, phrase []string) bool {
+	for _, tokens := range texts {
+	next:
+		for i := 0; i+len(phrase) <= len(tokens); i++ {
+			for j, token := range phrase {
+				if tokens[i+j] != token {
+					continue next
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package kv
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// 查询解析: 空格为 AND, 大写的 OR 分组, 引号内和切出多个词的项为短语
+func TestParseQuery(t *testing.T) {
+	var cases = []struct {
+		query  string
+		groups [][][]string
+		err    bool
+	}{
+		{"timeout", [][][]string{{{"timeout"}}}, false},
+		{"Timeout  PANIC", [][][]string{{{"timeout"}, {"panic"}}}, false},
+		{"timeout AND panic", [][][]string{{{"timeout"}, {"panic"}}}, false},
+		{`timeout "connection reset" OR panic`, [][][]string{{{"timeout"}, {"connection", "reset"}}, {{"panic"}}}, false},
+		{"a or b", [][][]string{{{"a"}, {"or"}, {"b"}}}, false},
+		{"user_id=42", [][][]string{{{"user", "id", "42"}}}, false},
+		{"连接超时", [][][]string{{{"连", "接", "超", "时"}}}, false},
+		{"", nil, true},
+		{"OR panic", nil, true},
+		{"panic OR", nil, true},
+		{"a OR OR b", nil, true},
+		{`"connection reset`, nil, true},
+		{`"" OR x`, nil, true},
+	}
+	for _, c := range cases {
+		q, err := ParseQuery(c.query)
+		if c.err {
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Fatalf("%q: expect ErrInvalidQuery, got %v", c.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", c.query, err)
+		}
+		if !reflect.DeepEqual(q.groups, c.groups) {
+			t.Fatalf("%q: groups %q, want %q", c.query, q.groups, c.groups)
+		}
+	}
+}
+
+// 短语要在同一个字段里连续出现, 单个词出现在任意字段即可
+func TestQueryMatch(t *testing.T) {
+	var texts = [][]string{
+		tokenize("read tcp 10.0.0.1: connection reset by peer"),
+		tokenize("数据库连接超时"),
+	}
+	var cases = []struct {
+		query string
+		match bool
+	}{
+		{"connection", true},
+		{"CONNECTION reset", true},
+		{`"connection reset"`, true},
+		{`"reset connection"`, false},
+		{`"connection peer"`, false},
+		{"reset peer", true},
+		{"连接超时", true},
+		{"超时连接", false},
+		{"数据 超时", true},
+		{"timeout", false},
+		{"timeout OR peer", true},
+		{`"reset 数据库"`, false},
+		{"10.0.0.1", true},
+	}
+	for _, c := range cases {
+		q, err := ParseQuery(c.query)
+		if err != nil {
+			t.Fatalf("%q: %v", c.query, err)
+		}
+		if q.match(texts) != c.match {
+			t.Fatalf("%q: match %v, want %v", c.query, !c.match, c.match)
+		}
+	}
+}
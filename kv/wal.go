@@ -0,0 +1,309 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+const walExt = ".wal"
+
+// 记录第一个还没有落盘的预写日志编号, 编号更小的日志里的数据都已经写到段文件
+// flush 在段文件fsync之后, 删除旧日志之前更新, 中间崩溃时重放也会跳过这些日志
+// 段文件fsync之后, 更新之前崩溃的, 重放时按内容去掉已经落盘的数据
+const walCheckpointFile = "wal.checkpoint"
+
+// SyncPolicy 预写日志的落盘策略
+type SyncPolicy int
+
+const (
+	// SyncAlways 每批写入后fsync, 返回即落盘
+	SyncAlways SyncPolicy = iota
+	// SyncInterval 每隔一段时间fsync一次, 写入等到fsync之后才返回
+	SyncInterval
+	// SyncNone 只写到操作系统的缓冲区
+	SyncNone
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "none":
+		return SyncNone, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown sync policy %q", s)
+}
+
+// wal 预写日志, 缓存中的数据刷到段文件之前先写到这里
+type wal struct {
+	sync.Mutex
+	id     int64
+	fd     *os.File
+	size   int64
+	closed bool
+	sealer *sealer
+}
+
+func walName(dirname string, id int64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%020d%s", id, walExt))
+}
+
+func openWal(dirname string, id int64, keys *Keyring) (*wal, error) {
+	fd, err := os.OpenFile(walName(dirname, id), os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModeAppend|os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	keyID, size, err := initFileHeader(fd, info.Size(), keys.activeID())
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	sl, err := keys.sealer(keyID)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &wal{id: id, fd: fd, size: size, sealer: sl}, nil
+}
+
+// write 一批记录一次写入
+func (w *wal) write(records [][]byte) error {
+	var buf bytes.Buffer
+	for _, data := range records {
+		buf.Write(encodeRecord(w.sealer.seal(data)))
+	}
+	w.Lock()
+	defer w.Unlock()
+	n, err := w.fd.Write(buf.Bytes())
+	if err != nil {
+		w.fd.Truncate(w.size)
+		return err
+	}
+	w.size += int64(n)
+	return nil
+}
+
+func (w *wal) sync() error {
+	w.Lock()
+	defer w.Unlock()
+	// 关闭前已经fsync过了
+	if w.closed {
+		return nil
+	}
+	return w.fd.Sync()
+}
+
+func (w *wal) close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.fd.Sync(); err != nil {
+		w.fd.Close()
+		return err
+	}
+	return w.fd.Close()
+}
+
+// rotateWal 切换到新的预写日志, 需要持有 e.Lock
+func (e *KvEngine) rotateWal() error {
+	w, err := openWal(e.meta.dirname, e.wal.id+1, e.meta.keys)
+	if err != nil {
+		return err
+	}
+	old := e.wal
+	e.wal = w
+	return old.close()
+}
+
+// removeWals 删除编号小于id的预写日志, 其中的数据都已经写到段文件
+// 先记下id, 删除到一半崩溃时剩下的日志也不会重放
+func (e *KvEngine) removeWals(id int64) error {
+	if err := writeWalCheckpoint(e.meta.dirname, id); err != nil {
+		return err
+	}
+	ids, err := listFiles(e.meta.dirname, walExt)
+	if err != nil {
+		return err
+	}
+	for _, i := range ids {
+		if i >= id {
+			break
+		}
+		if err := os.Remove(walName(e.meta.dirname, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayWal 启动时把还没刷到段文件的数据重新放回缓存
+func (e *KvEngine) replayWal() error {
+	ids, err := listFiles(e.meta.dirname, walExt)
+	if err != nil {
+		return err
+	}
+	flushed, err := readWalCheckpoint(e.meta.dirname)
+	if err != nil {
+		return err
+	}
+	// 新日志的编号不能小于检查点, 否则会被当成已经落盘的日志
+	var last = flushed - 1
+	for _, id := range ids {
+		if id < flushed {
+			log.Printf("wal %d: already flushed, skip", id)
+			continue
+		}
+		n, err := e.replayWalFile(walName(e.meta.dirname, id))
+		if err != nil {
+			return err
+		}
+		log.Printf("wal %d: replay %d records", id, n)
+		last = id
+	}
+	if n := e.dropFlushed(); n > 0 {
+		log.Printf("wal: drop %d records already flushed", n)
+	}
+	e.wal, err = openWal(e.meta.dirname, last+1, e.meta.keys)
+	return err
+}
+
+// dropFlushed 段文件fsync之后, 写检查点之前崩溃时, 重放的数据已经在段文件里
+// 和索引指向的数据完全相同的从缓存中去掉, 否则会再落盘一次, 在变更流里重复出现
+// 内容相同的覆盖写入也会去掉, 读到的数据不变
+func (e *KvEngine) dropFlushed() int {
+	var keys []primitive.ObjectID
+	var iter = e.cache.ToIter()
+	for iter.HasNext() {
+		var node = iter.Next()
+		pos, ok := e.indexer.Get(node.Key())
+		if !ok {
+			continue
+		}
+		if doc, err := e.get(pos); err == nil && bytes.Equal(doc, node.Val().([]byte)) {
+			keys = append(keys, node.Key())
+		}
+	}
+	for _, key := range keys {
+		atomic.AddInt64(&e.memBytes, -int64(len(e.cache.Get(key).Val().([]byte))))
+		e.cache.Del(key)
+	}
+	return len(keys)
+}
+
+// readWalCheckpoint 文件不存在时返回0, 所有的日志都要重放
+func readWalCheckpoint(dirname string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dirname, walCheckpointFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func writeWalCheckpoint(dirname string, id int64) error {
+	return writeFileAtomic(filepath.Join(dirname, walCheckpointFile), func(w io.Writer) error {
+		_, err := io.WriteString(w, strconv.FormatInt(id, 10))
+		return err
+	})
+}
+
+func (e *KvEngine) replayWalFile(name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < fileHeaderSize {
+		return 0, nil
+	}
+	keyID, size, err := initFileHeader(f, info.Size(), 0)
+	if err != nil {
+		return 0, err
+	}
+	sl, err := e.meta.keys.sealer(keyID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	var r = bufio.NewReader(io.NewSectionReader(f, fileHeaderSize, size-fileHeaderSize))
+	var count = 0
+	for {
+		_, sealed, err := readRecord(r)
+		if err == nil {
+			sealed, err = sl.open(sealed)
+		}
+		var data = sealed
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			if isTornRecord(err) {
+				// 没有写完的尾部, 这部分写入没有返回成功
+				log.Printf("wal %s: drop torn tail: %v", name, err)
+				return count, nil
+			}
+			return count, err
+		}
+		doc, err := bsoncore.NewDocumentFromReader(bytes.NewBuffer(data))
+		if err != nil {
+			continue
+		}
+		_id, ok := doc.Lookup("_id").ObjectIDOK()
+		if !ok {
+			continue
+		}
+		e.apply(_id, doc, data)
+		count++
+	}
+}
+
+// commitWal 按落盘策略fsync, 然后推送给订阅者并通知等待的写入
+func (e *KvEngine) commitWal(pending []*setReq) []*setReq {
+	if len(pending) == 0 {
+		return pending
+	}
+	var err error
+	if e.meta.syncPolicy != SyncNone {
+		e.Lock()
+		w := e.wal
+		e.Unlock()
+		err = w.sync()
+	}
+	// 落盘之后再推送给订阅者, 在锁外推送, 订阅的过滤条件不占用锁
+	if err == nil {
+		publish(pending)
+	}
+	for _, req := range pending {
+		req.done <- err
+		req.subs = nil
+	}
+	return pending[:0]
+}
@@ -3,26 +3,118 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"log"
 	"logkv/kv"
 	"logkv/server"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	_ "github.com/davyxu/cellnet/peer/tcp"
 	_ "github.com/davyxu/cellnet/proc/tcp"
 )
 
-var port int
+var (
+	port         int
+	dirname      string
+	segmentSize  int64
+	rollInterval time.Duration
+	syncPolicy   string
+	syncInterval time.Duration
+	retainAge    time.Duration
+	retainSize   int64
+	compression  string
+	blockSize    int
+	keyFile      string
+	memLimit     int64
+	traceKey     string
+	indexes      string
+	textFields   string
+	flushEvery   time.Duration
+	consumerKeep bool
+	leader       string
+	followName   string
+	followFrom   string
+	followLive   bool
+)
 
 func main() {
 	flag.IntVar(&port, "p", 3210, "port")
+	flag.StringVar(&dirname, "d", "data", "data dir")
+	flag.Int64Var(&segmentSize, "segment-size", 256*1024*1024, "max bytes of a segment file")
+	flag.DurationVar(&rollInterval, "roll-interval", 0, "roll segment at time boundary, e.g. 24h")
+	flag.StringVar(&syncPolicy, "sync", "always", "wal fsync policy: always, interval or none")
+	flag.DurationVar(&syncInterval, "sync-interval", 10*time.Millisecond, "group commit interval when -sync=interval")
+	flag.DurationVar(&retainAge, "retention-age", 0, "drop segments older than this, e.g. 336h")
+	flag.Int64Var(&retainSize, "retention-size", 0, "drop oldest segments when total bytes exceed this")
+	flag.StringVar(&compression, "compression", "snappy", "block compression: none, snappy or zstd")
+	flag.IntVar(&blockSize, "block-size", 64*1024, "uncompressed bytes per block, at most 15MB")
+	flag.StringVar(&keyFile, "key-file", "", "encryption keys, one id:hex per line; falls back to $LOGKV_KEYS")
+	flag.Int64Var(&memLimit, "mem-limit", 256*1024*1024, "memtable bytes; flush at a quarter, reject writes when full")
+	flag.StringVar(&traceKey, "trace-key", "", "index documents by this field, dotted path for nested fields")
+	flag.StringVar(&indexes, "index", "", "comma separated fields to build secondary indexes on, e.g. app,level,user_id")
+	flag.StringVar(&textFields, "text-fields", "", "comma separated string fields to build a full-text index on, e.g. Custom")
+	flag.DurationVar(&flushEvery, "flush-interval", 10*time.Second, "flush the memtable at least this often so change feed consumers see new data, 0 to flush by size only")
+	flag.BoolVar(&consumerKeep, "consumer-retention", true, "keep segments that change feed consumers have not read yet")
+	flag.StringVar(&leader, "follow", "", "run as a read-only follower of this leader, host:port")
+	flag.StringVar(&followName, "follow-name", "", "consumer name of this follower on the leader, defaults to follower-<hostname>-<port>")
+	flag.StringVar(&followFrom, "follow-from", "", "replicate again from this leader offset, segment:offset:inblock")
+	flag.BoolVar(&followLive, "follow-live", false, "also replicate records the leader has not flushed yet")
 	flag.Parse()
 
+	policy, err := kv.ParseSyncPolicy(syncPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	compress, err := kv.ParseCompression(compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var keys *kv.Keyring
+	if keyFile != "" {
+		keys, err = kv.LoadKeyringFile(keyFile)
+	} else if spec := os.Getenv("LOGKV_KEYS"); spec != "" {
+		keys, err = kv.LoadKeyring(spec)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	var engine = kv.NewKvEngine(ctx, "sample.kv")
+	var engine = kv.NewKvEngine(ctx, dirname,
+		kv.WithSegmentSize(segmentSize),
+		kv.WithRollInterval(rollInterval),
+		kv.WithSyncPolicy(policy, syncInterval),
+		kv.WithRetention(retainAge, retainSize),
+		kv.WithCompression(compress, blockSize),
+		kv.WithKeyring(keys),
+		kv.WithMemLimit(memLimit),
+		kv.WithTraceKey(traceKey),
+		kv.WithIndexes(splitFields(indexes)...),
+		kv.WithTextFields(splitFields(textFields)...),
+		kv.WithFlushInterval(flushEvery),
+		kv.WithConsumerRetention(consumerKeep),
+	)
 
 	s := server.NewServer(ctx, engine)
+	if leader != "" {
+		var opts = server.FollowOptions{Leader: leader, Name: followName, Live: followLive}
+		if opts.Name == "" {
+			host, _ := os.Hostname()
+			opts.Name = fmt.Sprintf("follower-%s-%d", host, port)
+		}
+		if followFrom != "" {
+			var from kv.Position
+			if _, err := fmt.Sscanf(followFrom, "%d:%d:%d", &from.Segment, &from.Offset, &from.InBlock); err != nil {
+				log.Fatal("bad -follow-from: ", err)
+			}
+			opts.From = &from
+		}
+		s.Follow(ctx, opts)
+	}
 	go s.Run(int16(port))
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -30,3 +122,14 @@ func main() {
 	cancel()
 	s.Close()
 }
+
+// splitFields 逗号分隔的字段列表, 忽略空白
+func splitFields(s string) []string {
+	var fields []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
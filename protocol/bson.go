@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"github.com/davyxu/cellnet"
+	"github.com/davyxu/cellnet/codec"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// bsonCodec 用bson编码消息
+// binary编码不支持 [][]byte 和结构体切片这类嵌套的切片, 这类消息用bson
+// binary计算 []string 的长度时每个字符串按16字节算, 长的字符串编码时会越界, 带 []string 的消息也用bson
+type bsonCodec struct {
+}
+
+func (self *bsonCodec) Name() string {
+	return "bson"
+}
+
+func (self *bsonCodec) MimeType() string {
+	return "application/bson"
+}
+
+func (self *bsonCodec) Encode(msgObj interface{}, ctx cellnet.ContextSet) (data interface{}, err error) {
+	return bson.Marshal(msgObj)
+}
+
+func (self *bsonCodec) Decode(data interface{}, msgObj interface{}) error {
+	return bson.Unmarshal(data.([]byte), msgObj)
+}
+
+func init() {
+	codec.RegisterCodec(new(bsonCodec))
+}
@@ -9,71 +9,277 @@ import (
 	"github.com/davyxu/cellnet/util"
 )
 
+// 返回码
+const (
+	CodeOK         = 0
+	CodeBadRequest = 400
+	// 从节点只读, 写入和删除要发到主节点
+	CodeReadOnly = 403
+	CodeNotFound = 404
+	// 流式扫描长时间没有确认
+	CodeTimeout = 408
+	// 单条数据超过 MaxPayload, 无法返回
+	CodeTooLarge = 413
+	// 客户端取消了流式扫描
+	CodeCanceled = 499
+	CodeInternal = 500
+	// 服务端过载, 客户端应等待 RetryAfter 毫秒后重试
+	CodeOverloaded = 503
+)
+
 type CodeAck struct {
 	Code    uint32
 	Message string
 }
 
+// SetReq 文档没有_id时由服务端分配, 同一个节点分配的key递增
 type SetReq struct {
 	Data []byte
 }
+
+// SetAck Key 为写入数据的key, 十六进制
 type SetAck struct {
 	CodeAck
+	RetryAfter uint32
+	Key        string
 }
 
 type BatchSetReq struct {
 	Sets [][]byte
 }
+
+// BatchSetAck 有写入失败时 Code 为第一个失败的返回码, Failed 列出每条失败的数据
+// Keys 和 BatchSetReq.Sets 一一对应, 失败的为空
 type BatchSetAck struct {
 	CodeAck
+	RetryAfter uint32
+	Keys       []string
+	Failed     []SetFailure
 }
 
+// SetFailure 批量写入中失败的一条, Index 为在 BatchSetReq.Sets 中的下标
+type SetFailure struct {
+	Index   int32
+	Code    uint32
+	Message string
+}
+
+// GetReq Include/Exclude 为返回的字段, 嵌套字段用点分隔, 只能指定一个, Include 时可以 Exclude _id
 type GetReq struct {
-	Key string
+	Key     string
+	Include []string
+	Exclude []string
 }
 
+// GetAck Key 为请求的key
 type GetAck struct {
 	CodeAck
+	Key  string
 	Data []byte
 }
 
+// BatchGetReq Keys 为十六进制的ObjectID
 type BatchGetReq struct {
-	Keys []string
+	Keys    []string
+	Include []string
+	Exclude []string
 }
 
+// BatchGetAck 结果按请求的顺序返回, 每个key一个 GetAck, 分别带返回码
+// 结果超过 MaxPayload 时分成多个消息, Offset 为第一条在 Keys 中的下标, More 表示后面还有
 type BatchGetAck struct {
 	CodeAck
-	Datas []byte
+	Offset int32
+	Datas  []GetAck
+	More   bool
 }
 
+// ScanReq 按key的顺序扫描一个范围, 首尾都包含
+// StartKey/EndKey 为十六进制的ObjectID, 为空时按 StartTime/EndTime(秒) 计算, 都为空表示不限
+// Limit 为一页最多的条数, 为0时使用默认值
+// Reverse 为true时从结束位置开始倒序返回, 最新的数据在前
 type ScanReq struct {
-	StartIndex uint64
-	EndIndex   uint64
-	StartTime  uint64
-	EndTime    uint64
+	StartKey  string
+	EndKey    string
+	StartTime uint32
+	EndTime   uint32
+	Limit     int32
+	Reverse   bool
+	// bson格式的过滤条件, 和mongo的查询文档写法相同, 为空不过滤
+	Filter []byte
+	// 返回的字段, 同 GetReq
+	Include []string
+	Exclude []string
 }
 
+// ScanAck 第一页数据, Cursor 不为空表示还有数据, 用 NextReq 继续
+// 一页的大小不超过 MaxPayload
 type ScanAck struct {
-	Datas []GetAck
+	CodeAck
+	Datas  []GetAck
+	Cursor string
 }
 
+// GetWithIndexReq 按二级索引等值查询, 按时间顺序返回
+// Cursor 为上一页返回的值, 第一页为空
 type GetWithIndexReq struct {
 	FieldName string
 	FieldVal  string
+	Cursor    string
+	Limit     int32
 }
 
+// GetWithIndexAck Cursor 为空表示没有更多数据
 type GetWithIndexAck struct {
-	Datas []GetAck
+	CodeAck
+	Datas  []GetAck
+	Cursor string
 }
 
+// ScanWithIndexReq 按二级索引范围查询, 数字按数值比较, 其他按字符串比较, FieldValEnd 为空不限制
 type ScanWithIndexReq struct {
 	FieldName     string
 	FieldValStart string
 	FieldValEnd   string
+	Cursor        string
+	Limit         int32
 }
 
 type ScanWithIndexAck struct {
-	Datas []GetAck
+	CodeAck
+	Datas  []GetAck
+	Cursor string
+}
+
+// SearchReq 全文查询, 例如 `timeout "connection reset" OR panic`, 按时间顺序返回
+// StartTime/EndTime 为0不限制; KeysOnly 时只返回key
+type SearchReq struct {
+	Query     string
+	StartTime uint32
+	EndTime   uint32
+	Cursor    string
+	Limit     int32
+	KeysOnly  bool
+}
+
+type SearchAck struct {
+	CodeAck
+	Datas  []GetAck
+	Cursor string
+}
+
+// AggregateReq 统计 StartTime 到 EndTime 之间满足 Filter 的数据, 时间为0不限制
+// 按 GroupBy 字段的值分组, Interval 秒按时间分桶, 0不分桶
+// Fields 为要统计最小, 最大, 平均值和 Percentiles(0到100) 的数值字段
+type AggregateReq struct {
+	StartTime   uint32
+	EndTime     uint32
+	Filter      []byte
+	GroupBy     []string
+	Interval    uint32
+	Fields      []string
+	Percentiles []float64
+}
+
+// AggregateAck 结果超过 MaxPayload 时分成多个消息, More 表示后面还有
+type AggregateAck struct {
+	CodeAck
+	Buckets []AggBucket
+	More    bool
+}
+
+// AggBucket Time 为时间桶开始的时间, Group 和 GroupBy 一一对应, Stats 和 Fields 一一对应
+type AggBucket struct {
+	Time  uint32
+	Group []string
+	Count int64
+	Stats []FieldStats
+}
+
+// FieldStats Count 为有数值的条数, Percentiles 和请求的一一对应
+type FieldStats struct {
+	Count       int64
+	Min         float64
+	Max         float64
+	Avg         float64
+	Percentiles []float64
+}
+
+// LogOffset 变更流里的位置: 段编号 + 块在段内的偏移 + 文档在块内的偏移, 全为0表示最老的数据
+type LogOffset struct {
+	Segment int64
+	Offset  int64
+	InBlock int32
+}
+
+// ChangesReq 按落盘的顺序读取数据, Consumer 不为空时从它提交的位置开始读, 第一次读时注册
+// Consumer 为空时从 From 开始读, 不保存位置
+// ReqID 原样带回应答, 客户端用它丢掉超时之后迟到的应答
+type ChangesReq struct {
+	Consumer string
+	From     LogOffset
+	Limit    int32
+	ReqID    uint32
+}
+
+// ChangesAck Offsets 和 Datas 一一对应, 处理完之后提交 Next, 没有新数据时 Datas 为空
+// Lag 为 Next 之后还没读的落盘数据的字节数
+type ChangesAck struct {
+	CodeAck
+	Datas   []GetAck
+	Offsets []LogOffset
+	Next    LogOffset
+	Lag     int64
+	ReqID   uint32
+}
+
+// CommitReq 提交消费者处理到的位置, 重启后从这里继续
+type CommitReq struct {
+	Consumer string
+	Offset   LogOffset
+	ReqID    uint32
+}
+
+type CommitAck struct {
+	CodeAck
+	ReqID uint32
+}
+
+// RemoveConsumerReq 删除消费者, 保留策略不再为它保留数据
+type RemoveConsumerReq struct {
+	Consumer string
+}
+
+type RemoveConsumerAck struct {
+	CodeAck
+}
+
+// ReplicaStatusReq 查询复制状态, 主节点返回每个消费者的延迟, 从节点返回自己的复制进度
+type ReplicaStatusReq struct {
+}
+
+// ReplicaStatusAck Role 为 leader 或者 follower
+// 从节点: Offset 为在主节点上已经复制到的位置, Lag 为主节点上还没复制的落盘数据的字节数
+// LastApplied 为最后一次写入复制数据的时间, Error 为最近一次复制失败的原因
+// 主节点: Offset 为变更流的末尾, Consumers 为各个消费者(包括从节点)的位置和延迟
+type ReplicaStatusAck struct {
+	CodeAck
+	Role        string
+	Leader      string
+	Connected   bool
+	Offset      LogOffset
+	Lag         int64
+	Applied     int64
+	LastKey     string
+	LastApplied uint32
+	Error       string
+	Consumers   []ConsumerLag
+}
+
+type ConsumerLag struct {
+	Name   string
+	Offset LogOffset
+	Lag    int64
 }
 
 type DeleteReq struct {
@@ -84,12 +290,88 @@ type DeleteAck struct {
 	CodeAck
 }
 
+// RetentionReq 查询保留策略和当前保留的最早数据
+type RetentionReq struct {
+}
+
+type RetentionAck struct {
+	CodeAck
+	Oldest   uint32
+	MaxAge   int64
+	MaxSize  int64
+	Segments int32
+	Size     int64
+}
+
+// ScanStreamReq 流式扫描, 服务端按块推送 ScanChunk, 不用逐页请求
+// StreamID 由客户端指定, 同一个连接上不能重复; Limit 为总条数, 0表示不限
+// Window 为未确认的块数上限, 超过后服务端暂停发送, 0使用默认值
+type ScanStreamReq struct {
+	ScanReq
+	StreamID uint32
+	Window   int32
+}
+
+// ScanChunk 流式扫描的一块, 不超过 MaxPayload, Seq 从0开始递增
+// End 为true表示流结束, 出错或者被取消时 Code 不为0
+type ScanChunk struct {
+	CodeAck
+	StreamID uint32
+	Seq      uint32
+	Datas    []GetAck
+	End      bool
+}
+
+// StreamNextReq 确认已经处理完 Seq 及之前的块, 服务端继续发送
+type StreamNextReq struct {
+	StreamID uint32
+	Seq      uint32
+}
+
+// StreamCancelReq 取消流式扫描, 服务端会发送一个带 CodeCanceled 的结束块
+type StreamCancelReq struct {
+	StreamID uint32
+}
+
+// SubscribeReq 订阅新写入的数据, 服务端用 ScanChunk 推送, 确认和取消同流式扫描, 共用 StreamID
+// Filter 和 Trace 为空时推送所有数据, Resume 为最后收到的key时先补发之后的已有数据
+// 订阅者处理太慢时以 CodeOverloaded 结束, 从最后收到的key重新订阅不会漏数据
+type SubscribeReq struct {
+	StreamID uint32
+	Window   int32
+	Filter   []byte
+	Trace    string
+	Resume   string
+	Include  []string
+	Exclude  []string
+}
+
+// NextReq 从上一页返回的 Cursor 继续扫描, 返回的字段需要重新指定, 同 GetReq
 type NextReq struct {
-	Offset int64
+	Cursor  string
+	Limit   int32
+	Include []string
+	Exclude []string
 }
 
 type NextAck struct {
-	Offset int64
+	CodeAck
+	Datas  []GetAck
+	Cursor string
+}
+
+// TraceReq 按时间顺序查询一个链路的所有日志, Cursor 为上一页返回的值, 第一页为空
+type TraceReq struct {
+	Trace  string
+	Cursor string
+	Limit  int32
+}
+
+// TraceAck Cursor 为空表示没有更多数据
+type TraceAck struct {
+	CodeAck
+	Datas  []GetAck
+	Cursor string
 }
 
 func init() {
@@ -106,7 +388,18 @@ func init() {
 		ID:    int(util.StringHash("proto.SetAck")),
 	})
 	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
-		Codec: codec.MustGetCodec("binary"),
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*BatchSetReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.BatchSetReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*BatchSetAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.BatchSetAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
 		Type:  reflect.TypeOf((*GetReq)(nil)).Elem(),
 		ID:    int(util.StringHash("proto.GetReq")),
 	})
@@ -118,14 +411,182 @@ func init() {
 	})
 
 	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
-		Codec: codec.MustGetCodec("binary"),
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*BatchGetReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.BatchGetReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*BatchGetAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.BatchGetAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
 		Type:  reflect.TypeOf((*ScanReq)(nil)).Elem(),
 		ID:    int(util.StringHash("proto.ScanReq")),
 	})
 	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
-		Codec: codec.MustGetCodec("binary"),
+		Codec: codec.MustGetCodec("bson"),
 		Type:  reflect.TypeOf((*ScanAck)(nil)).Elem(),
 		ID:    int(util.StringHash("proto.ScanAck")),
 	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*NextReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.NextReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*NextAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.NextAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*ScanStreamReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ScanStreamReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*ScanChunk)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ScanChunk")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*StreamNextReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.StreamNextReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*StreamCancelReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.StreamCancelReq")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*SubscribeReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.SubscribeReq")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*DeleteReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.DeleteReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*DeleteAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.DeleteAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*RetentionReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.RetentionReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*RetentionAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.RetentionAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*TraceReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.TraceReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*TraceAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.TraceAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*GetWithIndexReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.GetWithIndexReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*GetWithIndexAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.GetWithIndexAck")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*ScanWithIndexReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ScanWithIndexReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*ScanWithIndexAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ScanWithIndexAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*SearchReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.SearchReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*SearchAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.SearchAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*AggregateReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.AggregateReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*AggregateAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.AggregateAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*ChangesReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ChangesReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*ChangesAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ChangesAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*CommitReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.CommitReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*CommitAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.CommitAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*RemoveConsumerReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.RemoveConsumerReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*RemoveConsumerAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.RemoveConsumerAck")),
+	})
+
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("binary"),
+		Type:  reflect.TypeOf((*ReplicaStatusReq)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ReplicaStatusReq")),
+	})
+	cellnet.RegisterMessageMeta(&cellnet.MessageMeta{
+		Codec: codec.MustGetCodec("bson"),
+		Type:  reflect.TypeOf((*ReplicaStatusAck)(nil)).Elem(),
+		ID:    int(util.StringHash("proto.ReplicaStatusAck")),
+	})
 
 }
@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davyxu/cellnet/codec"
+)
+
+// 带字段列表的请求, 路径比较长时也能编解码
+func TestEncodeLongPaths(t *testing.T) {
+	var include = []string{"request.headers.user_agent", "response." + strings.Repeat("x", 200)}
+	var exclude = []string{"_id"}
+	var scan = ScanReq{StartKey: "a", Limit: 10, Reverse: true, Filter: []byte{5, 0, 0, 0, 0}, Include: include, Exclude: exclude}
+	var msgs = []interface{}{
+		&GetReq{Key: "k", Include: include, Exclude: exclude},
+		&BatchGetReq{Keys: []string{"k1", "k2"}, Include: include},
+		&scan,
+		&NextReq{Cursor: "c", Limit: 5, Include: include, Exclude: exclude},
+		&ScanStreamReq{ScanReq: scan, StreamID: 3, Window: 4},
+		&SubscribeReq{StreamID: 7, Trace: "t", Resume: "r", Include: include, Exclude: exclude},
+	}
+	for _, msg := range msgs {
+		data, meta, err := codec.EncodeMessage(msg, nil)
+		if err != nil {
+			t.Fatalf("%T: %v", msg, err)
+		}
+		got, _, err := codec.DecodeMessage(meta.ID, data)
+		if err != nil {
+			t.Fatalf("%T: %v", msg, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Fatalf("%T: got %+v, want %+v", msg, got, msg)
+		}
+	}
+}
@@ -1,3 +1,7 @@
 package protocol
 
 const HeaderSize = 4
+
+// MaxPayload 单个消息体的上限
+// tcp.ltv 的包长是uint16, 超过64K会被截断, 留出消息头和编码的余量
+const MaxPayload = 60 * 1024
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"logkv/kv"
+	"logkv/protocol"
+	"time"
+
+	"github.com/davyxu/cellnet"
+)
+
+// aggregate 统计结果按 MaxPayload 分成多个消息发送
+func (s *Server) aggregate(sess cellnet.Session, req *protocol.AggregateReq) {
+	buckets, err := s.aggregateBuckets(req)
+	if err != nil {
+		var ack = &protocol.AggregateAck{}
+		ack.Message = err.Error()
+		ack.Code = protocol.CodeInternal
+		if errors.Is(err, kv.ErrInvalidAggregate) || errors.Is(err, kv.ErrInvalidFilter) ||
+			errors.Is(err, kv.ErrTooManyGroups) || errors.Is(err, ErrInvalidRange) {
+			ack.Code = protocol.CodeBadRequest
+		}
+		sess.Send(ack)
+		return
+	}
+
+	var ack = &protocol.AggregateAck{}
+	var size int
+	for _, b := range buckets {
+		var item = protocol.AggBucket{
+			Time:  uint32(b.Time),
+			Group: b.Group,
+			Count: b.Count,
+		}
+		for _, st := range b.Stats {
+			item.Stats = append(item.Stats, protocol.FieldStats(st))
+		}
+		var n = bucketSize(&item)
+		if size+n > protocol.MaxPayload && len(ack.Buckets) > 0 {
+			ack.More = true
+			sess.Send(ack)
+			ack = &protocol.AggregateAck{}
+			size = 0
+		}
+		ack.Buckets = append(ack.Buckets, item)
+		size += n
+	}
+	sess.Send(ack)
+}
+
+func (s *Server) aggregateBuckets(req *protocol.AggregateReq) ([]kv.AggBucket, error) {
+	cur, err := scanRange(&protocol.ScanReq{StartTime: req.StartTime, EndTime: req.EndTime, Filter: req.Filter})
+	if err != nil {
+		if errors.Is(err, kv.ErrInvalidFilter) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRange, err)
+	}
+	return s.engine.Aggregate(cur.Start, cur.End, kv.AggregateOptions{
+		Filter:      cur.Filter,
+		GroupBy:     req.GroupBy,
+		Interval:    time.Duration(req.Interval) * time.Second,
+		Fields:      req.Fields,
+		Percentiles: req.Percentiles,
+	})
+}
+
+// bucketSize 估算一个 AggBucket 编码后的大小
+func bucketSize(b *protocol.AggBucket) int {
+	var n = 64
+	for _, g := range b.Group {
+		n += len(g) + 16
+	}
+	for _, st := range b.Stats {
+		n += 96 + 16*len(st.Percentiles)
+	}
+	return n
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"logkv/kv"
+	"logkv/protocol"
+
+	"github.com/davyxu/cellnet"
+)
+
+// offsetSize 一个 LogOffset 用bson编码后在数组里的大小, 三个字段名和数组下标一共约56字节
+const offsetSize = 64
+
+// changes 读取一页变更, 按 MaxPayload 截断, 截断时 Next 为第一条没有返回的数据的位置
+func (s *Server) changes(sess cellnet.Session, req *protocol.ChangesReq) {
+	var ack = &protocol.ChangesAck{ReqID: req.ReqID}
+	defer sess.Send(ack)
+	var pos = kv.Position(req.From)
+	var err error
+	if req.Consumer != "" {
+		pos, err = s.engine.ConsumerOffset(req.Consumer)
+	}
+	var limit = int(req.Limit)
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+	var changes []kv.Change
+	if err == nil {
+		changes, pos, err = s.engine.Changes(pos, limit, protocol.MaxPayload)
+	}
+	if err != nil {
+		ack.Code, ack.Message = changesCode(err), err.Error()
+		return
+	}
+	var size int
+	for _, c := range changes {
+		var item = protocol.GetAck{Key: c.Key.Hex(), Data: c.Data}
+		if size+ackSize(&item)+offsetSize > protocol.MaxPayload && len(ack.Datas) > 0 {
+			pos = c.Pos
+			break
+		}
+		ack.Datas = append(ack.Datas, item)
+		ack.Offsets = append(ack.Offsets, protocol.LogOffset(c.Pos))
+		size += ackSize(&item) + offsetSize
+	}
+	ack.Next = protocol.LogOffset(pos)
+	ack.Lag = s.engine.LagBytes(pos)
+}
+
+func (s *Server) commit(sess cellnet.Session, req *protocol.CommitReq) {
+	var ack = &protocol.CommitAck{ReqID: req.ReqID}
+	if err := s.engine.CommitOffset(req.Consumer, kv.Position(req.Offset)); err != nil {
+		ack.Code, ack.Message = changesCode(err), err.Error()
+	}
+	sess.Send(ack)
+}
+
+func (s *Server) removeConsumer(sess cellnet.Session, req *protocol.RemoveConsumerReq) {
+	var ack = &protocol.RemoveConsumerAck{}
+	if err := s.engine.RemoveConsumer(req.Consumer); err != nil {
+		ack.Code, ack.Message = changesCode(err), err.Error()
+	}
+	sess.Send(ack)
+}
+
+func changesCode(err error) uint32 {
+	switch {
+	case errors.Is(err, kv.ErrNoConsumer):
+		return protocol.CodeNotFound
+	case errors.Is(err, kv.ErrInvalidConsumer), errors.Is(err, kv.ErrInvalidOffset), errors.Is(err, kv.ErrOffsetExpired):
+		return protocol.CodeBadRequest
+	}
+	return protocol.CodeInternal
+}
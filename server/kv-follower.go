@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"logkv/kv"
+	"logkv/protocol"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/davyxu/cellnet"
+	"github.com/davyxu/cellnet/peer"
+	"github.com/davyxu/cellnet/proc"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// 每次从主节点拉取的条数
+	followBatch = 1000
+	// 追上主节点之后再次拉取的间隔
+	followPoll = 500 * time.Millisecond
+	// 等待主节点应答的时间
+	followTimeout = 10 * time.Second
+	// 断线重连和出错重试的间隔
+	followRetry = time.Second
+	// 实时推送的流编号, 每个从节点和主节点只有一个连接
+	followStreamID = 1
+)
+
+var errLeaderTimeout = errors.New("leader did not answer in time")
+
+// FollowOptions 从节点的参数
+type FollowOptions struct {
+	// 主节点地址 host:port
+	Leader string
+	// 在主节点上的消费者名, 主节点按它保存复制的位置, 保留策略不会删除没复制的段
+	Name string
+	// 不为nil时从这个位置重新复制, 否则从主节点保存的位置继续
+	From *kv.Position
+	// 同时订阅主节点还没落盘的新数据, 延迟更低, 落盘后的数据仍然会按位置复制一次
+	Live bool
+}
+
+// follower 从主节点的变更流按位置拉取数据写入本地引擎, 每批写入成功后在主节点提交位置
+// 重复写入同一个key是覆盖, 所以中途失败重新拉取也不会出错
+type follower struct {
+	sync.Mutex
+	opts   FollowOptions
+	engine *kv.KvEngine
+	peer   cellnet.TCPConnector
+	// 主节点对拉取和提交请求的应答
+	acks chan interface{}
+	// 最近一次请求的编号, 只在 run 里使用
+	reqID uint32
+	// 实时推送的数据块
+	chunks chan *protocol.ScanChunk
+
+	connected   bool
+	offset      kv.Position
+	lag         int64
+	applied     int64
+	lastKey     primitive.ObjectID
+	lastApplied time.Time
+	err         string
+}
+
+// Follow 以从节点运行, 复制主节点的数据, 本节点只读
+func (s *Server) Follow(ctx context.Context, opts FollowOptions) {
+	var f = newFollower(s.engine, opts)
+	s.Lock()
+	s.follower = f
+	s.Unlock()
+
+	f.connect(ctx)
+	if opts.Live {
+		go f.applyLive(ctx)
+	}
+	go f.run(ctx)
+}
+
+func newFollower(engine *kv.KvEngine, opts FollowOptions) *follower {
+	return &follower{
+		opts:   opts,
+		engine: engine,
+		acks:   make(chan interface{}, 16),
+		chunks: make(chan *protocol.ScanChunk, maxStreamWindow+1),
+	}
+}
+
+// connect 连接主节点, 断线后自动重连, ctx 结束时断开
+func (f *follower) connect(ctx context.Context) {
+	queue := cellnet.NewEventQueue()
+	f.peer = peer.NewGenericPeer("tcp.Connector", "follower", f.opts.Leader, queue).(cellnet.TCPConnector)
+	f.peer.SetReconnectDuration(followRetry)
+	proc.BindProcessorHandler(f.peer, "tcp.ltv", f.handle)
+	f.peer.Start()
+	queue.StartLoop()
+
+	go func() {
+		<-ctx.Done()
+		f.peer.Stop()
+		queue.StopLoop()
+	}()
+}
+
+func (f *follower) handle(ev cellnet.Event) {
+	switch msg := ev.Message().(type) {
+	case *cellnet.SessionConnected:
+		f.setConnected(true)
+		if f.opts.Live {
+			f.subscribe()
+		}
+	case *cellnet.SessionClosed:
+		f.setConnected(false)
+	case *protocol.ScanChunk:
+		if msg.StreamID == followStreamID {
+			f.chunks <- msg
+		}
+	case *protocol.ChangesAck, *protocol.CommitAck:
+		select {
+		case f.acks <- msg:
+		default:
+		}
+	}
+}
+
+func (f *follower) subscribe() {
+	f.peer.Session().Send(&protocol.SubscribeReq{StreamID: followStreamID, Window: maxStreamWindow})
+}
+
+// run 拉取, 写入, 提交, 追上之后定时拉取
+func (f *follower) run(ctx context.Context) {
+	var from = f.opts.From
+	for ctx.Err() == nil {
+		if !f.isConnected() {
+			time.Sleep(followRetry)
+			continue
+		}
+		if from != nil {
+			if err := f.commit(*from); err != nil {
+				f.fail(err)
+				time.Sleep(followRetry)
+				continue
+			}
+			from = nil
+		}
+		n, err := f.pull()
+		if err != nil {
+			f.fail(err)
+			time.Sleep(followRetry)
+			continue
+		}
+		if n == 0 {
+			time.Sleep(followPoll)
+		}
+	}
+}
+
+// pull 拉取一批写入本地, 返回条数
+func (f *follower) pull() (int, error) {
+	f.reqID++
+	a, err := f.call(&protocol.ChangesReq{Consumer: f.opts.Name, Limit: followBatch, ReqID: f.reqID})
+	if err != nil {
+		return 0, err
+	}
+	var ack = a.(*protocol.ChangesAck)
+	if ack.Code != protocol.CodeOK {
+		return 0, fmt.Errorf("changes: %d %s", ack.Code, ack.Message)
+	}
+	if err := f.apply(ack.Datas); err != nil {
+		return 0, err
+	}
+	var next = kv.Position(ack.Next)
+	if len(ack.Datas) > 0 {
+		if err := f.commit(next); err != nil {
+			return 0, err
+		}
+	}
+	f.Lock()
+	f.offset, f.lag, f.err = next, ack.Lag, ""
+	f.Unlock()
+	return len(ack.Datas), nil
+}
+
+func (f *follower) commit(pos kv.Position) error {
+	f.reqID++
+	a, err := f.call(&protocol.CommitReq{Consumer: f.opts.Name, Offset: protocol.LogOffset(pos), ReqID: f.reqID})
+	if err != nil {
+		return err
+	}
+	if ack := a.(*protocol.CommitAck); ack.Code != protocol.CodeOK {
+		return fmt.Errorf("commit: %d %s", ack.Code, ack.Message)
+	}
+	return nil
+}
+
+// call 同一时间只有一个请求在等应答, 返回和请求同类型的应答
+// 超时之后迟到的应答编号和当前请求不同, 直接丢掉
+func (f *follower) call(msg interface{}) (interface{}, error) {
+	f.peer.Session().Send(msg)
+	var timer = time.NewTimer(followTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case a := <-f.acks:
+			if f.isReply(msg, a) {
+				return a, nil
+			}
+		case <-timer.C:
+			return nil, errLeaderTimeout
+		}
+	}
+}
+
+func (f *follower) isReply(msg, a interface{}) bool {
+	switch msg.(type) {
+	case *protocol.ChangesReq:
+		ack, ok := a.(*protocol.ChangesAck)
+		return ok && ack.ReqID == f.reqID
+	case *protocol.CommitReq:
+		ack, ok := a.(*protocol.CommitAck)
+		return ok && ack.ReqID == f.reqID
+	}
+	return false
+}
+
+// apply 写入本地, 过载时等一会儿重试, 不提交位置
+// 开启实时推送时已经写入过的数据不再写一遍
+func (f *follower) apply(datas []protocol.GetAck) error {
+	var keys = make([]primitive.ObjectID, 0, len(datas))
+	var sets = make([][]byte, 0, len(datas))
+	for _, d := range datas {
+		key, err := primitive.ObjectIDFromHex(d.Key)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		sets = append(sets, d.Data)
+	}
+	if f.opts.Live && len(keys) > 0 {
+		var olds, _ = f.engine.BatchGet(keys)
+		var n = 0
+		for i := range keys {
+			if !bytes.Equal(olds[i], sets[i]) {
+				keys[n], sets[n] = keys[i], sets[i]
+				n++
+			}
+		}
+		keys, sets = keys[:n], sets[:n]
+	}
+	for len(sets) > 0 {
+		_, errs := f.engine.BatchSet(sets)
+		var retry [][]byte
+		var retryKeys []primitive.ObjectID
+		for i, err := range errs {
+			switch {
+			case err == nil:
+				f.markApplied(keys[i])
+			case errors.Is(err, kv.ErrOverloaded):
+				retry = append(retry, sets[i])
+				retryKeys = append(retryKeys, keys[i])
+			default:
+				return fmt.Errorf("apply %s: %w", keys[i].Hex(), err)
+			}
+		}
+		if len(retry) > 0 {
+			time.Sleep(followRetry)
+		}
+		keys, sets = retryKeys, retry
+	}
+	return nil
+}
+
+// applyLive 写入实时推送的数据, 订阅结束后重新订阅, 漏掉的数据落盘后会按位置复制
+func (f *follower) applyLive(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk := <-f.chunks:
+			if err := f.apply(chunk.Datas); err != nil {
+				log.Println("follower live:", err)
+			}
+			if !chunk.End {
+				f.peer.Session().Send(&protocol.StreamNextReq{StreamID: followStreamID, Seq: chunk.Seq})
+				continue
+			}
+			if chunk.Code != protocol.CodeOK && chunk.Code != protocol.CodeCanceled {
+				log.Printf("follower live: %d %s, resubscribe", chunk.Code, chunk.Message)
+			}
+			time.Sleep(followRetry)
+			if f.isConnected() {
+				f.subscribe()
+			}
+		}
+	}
+}
+
+func (f *follower) markApplied(key primitive.ObjectID) {
+	f.Lock()
+	defer f.Unlock()
+	f.applied++
+	f.lastKey = key
+	f.lastApplied = time.Now()
+}
+
+func (f *follower) fail(err error) {
+	log.Println("follower:", err)
+	f.Lock()
+	defer f.Unlock()
+	f.err = err.Error()
+}
+
+func (f *follower) setConnected(connected bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.connected = connected
+}
+
+func (f *follower) isConnected() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.connected
+}
+
+func (f *follower) status(ack *protocol.ReplicaStatusAck) {
+	f.Lock()
+	defer f.Unlock()
+	ack.Role = "follower"
+	ack.Leader = f.opts.Leader
+	ack.Connected = f.connected
+	ack.Offset = protocol.LogOffset(f.offset)
+	ack.Lag = f.lag
+	ack.Applied = f.applied
+	ack.Error = f.err
+	if !f.lastKey.IsZero() {
+		ack.LastKey = f.lastKey.Hex()
+		ack.LastApplied = uint32(f.lastApplied.Unix())
+	}
+}
+
+// replicaStatus 从节点返回复制进度, 主节点返回各个消费者的延迟
+func (s *Server) replicaStatus(sess cellnet.Session) {
+	var ack = &protocol.ReplicaStatusAck{}
+	defer sess.Send(ack)
+	s.RLock()
+	var f = s.follower
+	s.RUnlock()
+	if f != nil {
+		f.status(ack)
+		return
+	}
+	ack.Role = "leader"
+	ack.Offset = protocol.LogOffset(s.engine.Head())
+	for name, pos := range s.engine.Consumers() {
+		ack.Consumers = append(ack.Consumers, protocol.ConsumerLag{
+			Name:   name,
+			Offset: protocol.LogOffset(pos),
+			Lag:    s.engine.LagBytes(pos),
+		})
+	}
+	sort.Slice(ack.Consumers, func(i, j int) bool { return ack.Consumers[i].Name < ack.Consumers[j].Name })
+}
+
+// readOnly 从节点拒绝写入和删除, 返回对应的应答, 其他请求返回nil
+func (s *Server) readOnly(msg interface{}) interface{} {
+	s.RLock()
+	var f = s.follower
+	s.RUnlock()
+	if f == nil {
+		return nil
+	}
+	var code = protocol.CodeAck{Code: protocol.CodeReadOnly, Message: "read-only follower of " + f.opts.Leader}
+	switch msg.(type) {
+	case *protocol.SetReq:
+		return &protocol.SetAck{CodeAck: code}
+	case *protocol.BatchSetReq:
+		return &protocol.BatchSetAck{CodeAck: code}
+	case *protocol.DeleteReq:
+		return &protocol.DeleteAck{CodeAck: code}
+	}
+	return nil
+}
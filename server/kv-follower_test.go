@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"logkv/kv"
+	"logkv/protocol"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/davyxu/cellnet"
+	"github.com/davyxu/cellnet/peer"
+	_ "github.com/davyxu/cellnet/peer/tcp"
+	"github.com/davyxu/cellnet/proc"
+	_ "github.com/davyxu/cellnet/proc/tcp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// listenLeader 在addr上接受连接, 处理和 Listen 相同, 返回实际的地址和停止函数
+// 停止时断开所有连接, 从节点看到的就是主节点下线
+func listenLeader(t *testing.T, s *Server, addr string) (string, func()) {
+	t.Helper()
+	queue := cellnet.NewEventQueue()
+	var p = peer.NewGenericPeer("tcp.Acceptor", "leader", addr, queue).(cellnet.TCPAcceptor)
+	proc.BindProcessorHandler(p, "tcp.ltv", s.handleEvent)
+	p.Start()
+	if p.Port() == 0 {
+		t.Fatalf("listen %s failed", addr)
+	}
+	queue.StartLoop()
+	return fmt.Sprintf("127.0.0.1:%d", p.Port()), func() {
+		p.Stop()
+		queue.StopLoop()
+	}
+}
+
+// waitFor 等到ok返回true, 超过10秒失败
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !ok(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// writeLeader 在主节点写入n条, 重启让数据落盘进入变更流
+func writeLeader(t *testing.T, leader *testServer, n int) map[primitive.ObjectID][]byte {
+	t.Helper()
+	var docs = make(map[primitive.ObjectID][]byte)
+	for i := 0; i < n; i++ {
+		data, _ := bson.Marshal(bson.M{"_id": primitive.NewObjectID(), "i": i, "msg": "hello logkv"})
+		key, err := leader.engine.Set(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[key] = data
+	}
+	leader.restart()
+	return docs
+}
+
+func checkReplicated(t *testing.T, follower *testServer, docs map[primitive.ObjectID][]byte) {
+	t.Helper()
+	for key, data := range docs {
+		if got, err := follower.engine.Get(key); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("follower get %s: %v", key.Hex(), err)
+		}
+	}
+}
+
+// 每次拉取之后在主节点提交的位置和从节点记录的相同, 延迟是主节点剩下的字节数, 不会变大, 最后为0
+// 之前请求的应答迟到时按编号丢掉, 不会写入本地也不会当成这次的应答
+func TestFollowerPull(t *testing.T) {
+	var leader = newTestServer(t, kv.WithSyncPolicy(kv.SyncNone, 0))
+	defer leader.cleanup()
+	var docs = writeLeader(t, leader, 2500)
+	addr, stop := listenLeader(t, leader.Server, "127.0.0.1:0")
+	defer stop()
+
+	var fs = newTestServer(t, kv.WithSyncPolicy(kv.SyncNone, 0))
+	defer fs.cleanup()
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var f = newFollower(fs.engine, FollowOptions{Leader: addr, Name: "f1"})
+	f.connect(ctx)
+	waitFor(t, "connect", f.isConnected)
+
+	var stale = primitive.NewObjectID()
+	var lastLag int64 = math.MaxInt64
+	var pulls int
+	for {
+		if pulls == 1 {
+			staleDoc, _ := bson.Marshal(bson.M{"_id": stale})
+			f.acks <- &protocol.ChangesAck{ReqID: f.reqID - 1, Datas: []protocol.GetAck{{Key: stale.Hex(), Data: staleDoc}}}
+			f.acks <- &protocol.CommitAck{ReqID: f.reqID}
+		}
+		n, err := f.pull()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		pulls++
+		var st protocol.ReplicaStatusAck
+		f.status(&st)
+		var committed = leader.engine.Consumers()["f1"]
+		if kv.Position(st.Offset) != committed {
+			t.Fatalf("pull %d: follower at %+v, committed %+v", pulls, st.Offset, committed)
+		}
+		if st.Lag != leader.engine.LagBytes(committed) || st.Lag > lastLag {
+			t.Fatalf("pull %d: lag %d, leader has %d bytes left, last lag %d", pulls, st.Lag, leader.engine.LagBytes(committed), lastLag)
+		}
+		lastLag = st.Lag
+	}
+
+	var st protocol.ReplicaStatusAck
+	f.status(&st)
+	if pulls < 3 || st.Applied != int64(len(docs)) || st.Lag != 0 || kv.Position(st.Offset) != leader.engine.Head() || st.Error != "" {
+		t.Fatalf("after %d pulls: %+v, leader head %+v", pulls, st, leader.engine.Head())
+	}
+	checkReplicated(t, fs, docs)
+	if _, err := fs.engine.Get(stale); err != kv.ErrNotFound {
+		t.Fatalf("stale ack applied: %v", err)
+	}
+}
+
+// 主节点下线再上线后, 从节点重连并从主节点保存的位置继续, 已经复制的数据不会再拉一次
+func TestFollowerReconnect(t *testing.T) {
+	var leader = newTestServer(t, kv.WithSyncPolicy(kv.SyncNone, 0))
+	defer leader.cleanup()
+	var docs = writeLeader(t, leader, 1000)
+	addr, stop := listenLeader(t, leader.Server, "127.0.0.1:0")
+
+	var fs = newTestServer(t, kv.WithSyncPolicy(kv.SyncNone, 0))
+	defer fs.cleanup()
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	fs.Follow(ctx, FollowOptions{Leader: addr, Name: "f1"})
+	var caughtUp = func(applied int) func() bool {
+		return func() bool {
+			var st protocol.ReplicaStatusAck
+			fs.follower.status(&st)
+			return st.Connected && st.Applied == int64(applied) && st.Lag == 0 && kv.Position(st.Offset) == leader.engine.Head()
+		}
+	}
+	waitFor(t, "first copy", caughtUp(len(docs)))
+	checkReplicated(t, fs, docs)
+
+	stop()
+	waitFor(t, "disconnect", func() bool { return !fs.follower.isConnected() })
+	var more = writeLeader(t, leader, 500)
+	_, stop = listenLeader(t, leader.Server, addr)
+	defer stop()
+
+	waitFor(t, "resume", caughtUp(len(docs)+len(more)))
+	checkReplicated(t, fs, more)
+	if pos := leader.engine.Consumers()["f1"]; pos != leader.engine.Head() {
+		t.Fatalf("committed %+v, leader head %+v", pos, leader.engine.Head())
+	}
+}
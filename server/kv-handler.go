@@ -1,72 +1,306 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"logkv/kv"
 	"logkv/protocol"
+	"time"
 
 	"github.com/davyxu/cellnet"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func (s *Server) Handle(sess cellnet.Session, msg interface{}) {
+	if ack := s.readOnly(msg); ack != nil {
+		sess.Send(ack)
+		return
+	}
 	switch req := msg.(type) {
 	//set
 	case *protocol.SetReq:
 		var ack = &protocol.SetAck{}
 		defer sess.Send(ack)
-
-		s.engine.Set(req.Data)
+		key, err := s.engine.Set(req.Data)
+		if err != nil {
+			ack.Code, ack.RetryAfter = setCode(err)
+			ack.Message = err.Error()
+			return
+		}
+		ack.Key = key.Hex()
 
 	//get
 	case *protocol.GetReq:
-		var ack = &protocol.GetAck{}
+		var ack = &protocol.GetAck{Key: req.Key}
 		defer sess.Send(ack)
 		key, err := primitive.ObjectIDFromHex(req.Key)
 		if err != nil {
-			ack.Code = 400
+			ack.Code = protocol.CodeBadRequest
+			ack.Message = err.Error()
+			return
+		}
+		proj, err := kv.NewProjection(req.Include, req.Exclude)
+		if err != nil {
+			ack.Code = protocol.CodeBadRequest
 			ack.Message = err.Error()
 			return
 		}
 		v, err := s.engine.Get(key)
 		if err != nil {
-			ack.Code = 400
+			ack.Code = getCode(err)
 			ack.Message = err.Error()
 			return
 		}
 
-		ack.Data = v
+		ack.Data = proj.Apply(v)
 
 	//delete
 	case *protocol.DeleteReq:
 		var ack protocol.DeleteAck
 		err := s.engine.Del(req.Time)
 		if err != nil {
-			ack.Code = 400
+			ack.Code = protocol.CodeBadRequest
 			ack.Message = err.Error()
 		}
 		sess.Send(&ack)
+	//retention
+	case *protocol.RetentionReq:
+		var stat = s.engine.Retention()
+		var ack = &protocol.RetentionAck{
+			MaxAge:   int64(stat.MaxAge / time.Second),
+			MaxSize:  stat.MaxSize,
+			Segments: int32(stat.Segments),
+			Size:     stat.Size,
+		}
+		if !stat.Oldest.IsZero() {
+			ack.Oldest = uint32(stat.Oldest.Unix())
+		}
+		sess.Send(ack)
 	//batchget
 	case *protocol.BatchGetReq:
-		// var ack protocol.BatchGetAck
-		// vs, err := s.engine.BatchGet(req.Keys)
-		// if err != nil {
-		// 	ack.Code = 400
-		// 	ack.Message = err.Error()
-		// }
-		// ack.Datas = vs.Bytes()
+		s.batchGet(sess, req)
 	//batchset
 	case *protocol.BatchSetReq:
 		var ack = &protocol.BatchSetAck{}
 		defer sess.Send(ack)
-		for _, v := range req.Sets {
-			s.engine.Set(v)
+		keys, errs := s.engine.BatchSet(req.Sets)
+		ack.Keys = make([]string, len(keys))
+		for i, err := range errs {
+			if err == nil {
+				ack.Keys[i] = keys[i].Hex()
+				continue
+			}
+			code, retry := setCode(err)
+			if len(ack.Failed) == 0 {
+				ack.Code = code
+			}
+			if retry > ack.RetryAfter {
+				ack.RetryAfter = retry
+			}
+			ack.Failed = append(ack.Failed, protocol.SetFailure{Index: int32(i), Code: code, Message: err.Error()})
+		}
+		if len(ack.Failed) > 0 {
+			ack.Message = fmt.Sprintf("%d of %d failed", len(ack.Failed), len(req.Sets))
 		}
 
 	//scan
 	case *protocol.ScanReq:
+		var ack = &protocol.ScanAck{}
+		defer sess.Send(ack)
+		cur, err := scanRange(req)
+		if err != nil {
+			ack.Code = protocol.CodeBadRequest
+			ack.Message = err.Error()
+			return
+		}
+		proj, err := kv.NewProjection(req.Include, req.Exclude)
+		if err != nil {
+			ack.Code = protocol.CodeBadRequest
+			ack.Message = err.Error()
+			return
+		}
+		ack.Datas, ack.Cursor, err = s.scan(cur, req.Limit, proj)
+		if err != nil {
+			ack.Code = protocol.CodeInternal
+			ack.Message = err.Error()
+		}
+	case *protocol.ScanStreamReq:
+		s.scanStream(sess, req)
+	case *protocol.SubscribeReq:
+		s.subscribe(sess, req)
+	case *protocol.StreamNextReq:
+		if st := s.getStream(sess.ID(), req.StreamID); st != nil {
+			st.ack(req.Seq)
+		}
+	case *protocol.StreamCancelReq:
+		if st := s.getStream(sess.ID(), req.StreamID); st != nil {
+			st.stop()
+		}
+	case *protocol.NextReq:
+		var ack = &protocol.NextAck{}
+		defer sess.Send(ack)
+		cur, err := decodeCursor(req.Cursor)
+		if err != nil {
+			ack.Code = protocol.CodeBadRequest
+			ack.Message = err.Error()
+			return
+		}
+		proj, err := kv.NewProjection(req.Include, req.Exclude)
+		if err != nil {
+			ack.Code = protocol.CodeBadRequest
+			ack.Message = err.Error()
+			return
+		}
+		ack.Datas, ack.Cursor, err = s.scan(cur, req.Limit, proj)
+		if err != nil {
+			ack.Code = protocol.CodeInternal
+			ack.Message = err.Error()
+		}
+	case *protocol.TraceReq:
+		var ack = &protocol.TraceAck{}
+		defer sess.Send(ack)
+		var err error
+		ack.Datas, ack.Cursor, err = s.findPage(req.Cursor, req.Limit, func(start primitive.ObjectID, opts kv.ScanOptions) ([][]byte, bool, error) {
+			return s.engine.Trace(req.Trace, start, opts)
+		})
+		ack.Code, ack.Message = findCode(err)
+	case *protocol.GetWithIndexReq:
+		var ack = &protocol.GetWithIndexAck{}
+		defer sess.Send(ack)
+		var err error
+		ack.Datas, ack.Cursor, err = s.findPage(req.Cursor, req.Limit, func(start primitive.ObjectID, opts kv.ScanOptions) ([][]byte, bool, error) {
+			return s.engine.Find(req.FieldName, req.FieldVal, start, opts)
+		})
+		ack.Code, ack.Message = findCode(err)
+	case *protocol.ReplicaStatusReq:
+		s.replicaStatus(sess)
+	case *protocol.ChangesReq:
+		s.changes(sess, req)
+	case *protocol.CommitReq:
+		s.commit(sess, req)
+	case *protocol.RemoveConsumerReq:
+		s.removeConsumer(sess, req)
+	case *protocol.AggregateReq:
+		s.aggregate(sess, req)
+	case *protocol.SearchReq:
+		var ack = &protocol.SearchAck{}
+		defer sess.Send(ack)
+		var err error
+		ack.Datas, ack.Cursor, err = s.search(req)
+		ack.Code, ack.Message = findCode(err)
+	case *protocol.ScanWithIndexReq:
+		var ack = &protocol.ScanWithIndexAck{}
+		defer sess.Send(ack)
+		var err error
+		ack.Datas, ack.Cursor, err = s.findPage(req.Cursor, req.Limit, func(start primitive.ObjectID, opts kv.ScanOptions) ([][]byte, bool, error) {
+			return s.engine.FindRange(req.FieldName, req.FieldValStart, req.FieldValEnd, start, opts)
+		})
+		ack.Code, ack.Message = findCode(err)
 
 	default:
 		log.Println("unkown msg", req)
 		return
 	}
 }
+
+// 过载时建议客户端等待的时间, 大约是一次刷盘的耗时
+const retryAfter = 200 * time.Millisecond
+
+// setCode 写入失败的返回码, 过载时带上重试间隔
+func setCode(err error) (uint32, uint32) {
+	if errors.Is(err, kv.ErrOverloaded) {
+		return protocol.CodeOverloaded, uint32(retryAfter / time.Millisecond)
+	}
+	if errors.Is(err, kv.ErrInvalidDocument) {
+		return protocol.CodeBadRequest, 0
+	}
+	return protocol.CodeInternal, 0
+}
+
+func getCode(err error) uint32 {
+	if errors.Is(err, kv.ErrNotFound) {
+		return protocol.CodeNotFound
+	}
+	return protocol.CodeInternal
+}
+
+// batchGet 非法的key不查询, 结果按请求顺序装进 BatchGetAck, 超过 MaxPayload 时分多个消息发送
+func (s *Server) batchGet(sess cellnet.Session, req *protocol.BatchGetReq) {
+	proj, err := kv.NewProjection(req.Include, req.Exclude)
+	if err != nil {
+		sess.Send(&protocol.BatchGetAck{CodeAck: protocol.CodeAck{Code: protocol.CodeBadRequest, Message: err.Error()}})
+		return
+	}
+	var items = make([]protocol.GetAck, len(req.Keys))
+	var keys = make([]primitive.ObjectID, 0, len(req.Keys))
+	var idx = make([]int, 0, len(req.Keys))
+	for i, hex := range req.Keys {
+		items[i].Key = hex
+		key, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			items[i].Code = protocol.CodeBadRequest
+			items[i].Message = err.Error()
+			continue
+		}
+		keys = append(keys, key)
+		idx = append(idx, i)
+	}
+	vs, errs := s.engine.BatchGet(keys)
+	for j, i := range idx {
+		if errs[j] != nil {
+			items[i].Code = getCode(errs[j])
+			items[i].Message = errs[j].Error()
+			continue
+		}
+		items[i].Data = proj.Apply(vs[j])
+	}
+
+	var ack = &protocol.BatchGetAck{}
+	var batch ackBatch
+	for i := range items {
+		if !batch.add(items[i]) {
+			ack.Datas, ack.More = batch.take(), true
+			sess.Send(ack)
+			ack = &protocol.BatchGetAck{Offset: int32(i)}
+			batch.add(items[i])
+		}
+	}
+	ack.Datas = batch.take()
+	sess.Send(ack)
+}
+
+// ackSize 估算一条 GetAck 编码后的大小
+func ackSize(ack *protocol.GetAck) int {
+	return len(ack.Key) + len(ack.Message) + len(ack.Data) + 64
+}
+
+// ackBatch 凑一个消息里的数据, 总大小不超过 MaxPayload
+type ackBatch struct {
+	datas []protocol.GetAck
+	size  int
+}
+
+// add 单条超过 MaxPayload 时换成 CodeTooLarge 不带数据
+// 加上之后超过 MaxPayload 时不加, 返回false, 这时先发送已有的; 空的时候总能加上
+func (b *ackBatch) add(item protocol.GetAck) bool {
+	if ackSize(&item) > protocol.MaxPayload {
+		item.Code = protocol.CodeTooLarge
+		item.Message = fmt.Sprintf("document of %d bytes exceeds max payload", len(item.Data))
+		item.Data = nil
+	}
+	var n = ackSize(&item)
+	if b.size+n > protocol.MaxPayload && len(b.datas) > 0 {
+		return false
+	}
+	b.datas = append(b.datas, item)
+	b.size += n
+	return true
+}
+
+// take 取出已有的数据, 重新开始
+func (b *ackBatch) take() []protocol.GetAck {
+	var datas = b.datas
+	b.datas, b.size = nil, 0
+	return datas
+}
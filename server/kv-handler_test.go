@@ -0,0 +1,49 @@
+package server
+
+import (
+	"logkv/protocol"
+	"testing"
+)
+
+// 超过上限的单条换成 CodeTooLarge, 放不下的留给下一个消息, 空的时候总能放下
+func TestAckBatch(t *testing.T) {
+	var doc = make([]byte, protocol.MaxPayload/3)
+	var items = []protocol.GetAck{
+		{Key: "a", Data: doc},
+		{Key: "b", Data: doc},
+		{Key: "c", Data: make([]byte, protocol.MaxPayload)},
+		{Key: "d", Data: doc},
+		{Key: "e", Data: doc},
+	}
+	var batch ackBatch
+	var msgs [][]protocol.GetAck
+	for _, item := range items {
+		if !batch.add(item) {
+			msgs = append(msgs, batch.take())
+			if !batch.add(item) {
+				t.Fatalf("%s: empty batch rejected", item.Key)
+			}
+		}
+	}
+	msgs = append(msgs, batch.take())
+
+	var want = [][]string{{"a", "b", "c"}, {"d", "e"}}
+	if len(msgs) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(msgs), len(want))
+	}
+	for i, msg := range msgs {
+		var size int
+		for j, item := range msg {
+			if item.Key != want[i][j] {
+				t.Fatalf("message %d item %d is %s, want %s", i, j, item.Key, want[i][j])
+			}
+			size += ackSize(&item)
+		}
+		if len(msg) != len(want[i]) || size > protocol.MaxPayload {
+			t.Fatalf("message %d: %d items, %d bytes", i, len(msg), size)
+		}
+	}
+	if c := msgs[0][2]; c.Code != protocol.CodeTooLarge || c.Data != nil {
+		t.Fatalf("oversized item: code %d, %d bytes", c.Code, len(c.Data))
+	}
+}
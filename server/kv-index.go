@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"logkv/kv"
+	"logkv/protocol"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// findPage 读取链路或者二级索引查询的一页, cursor 为下一页的起始key
+// find 按时间顺序返回不小于start的数据
+func (s *Server) findPage(cursor string, limit int32, find func(start primitive.ObjectID, opts kv.ScanOptions) ([][]byte, bool, error)) ([]protocol.GetAck, string, error) {
+	start, n, err := pageArgs(cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	kvs, more, err := find(start, kv.ScanOptions{
+		Limit:   n,
+		MaxSize: protocol.MaxPayload,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var batch ackBatch
+	var last primitive.ObjectID
+	for _, v := range kvs {
+		var key = kv.DocKey(v)
+		if !batch.add(protocol.GetAck{Key: key.Hex(), Data: v}) {
+			more = true
+			break
+		}
+		last = key
+	}
+	var datas = batch.take()
+	return datas, nextCursor(last, more && len(datas) > 0), nil
+}
+
+// pageArgs 解析分页的起始key和条数
+func pageArgs(cursor string, limit int32) (primitive.ObjectID, int, error) {
+	var start primitive.ObjectID
+	if cursor != "" {
+		var err error
+		if start, err = primitive.ObjectIDFromHex(cursor); err != nil {
+			return start, 0, ErrInvalidCursor
+		}
+	}
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+	return start, int(limit), nil
+}
+
+// nextCursor 下一页从last之后开始, 没有更多数据时为空
+func nextCursor(last primitive.ObjectID, more bool) string {
+	if !more {
+		return ""
+	}
+	next, ok := kv.NextKey(last)
+	if !ok {
+		return ""
+	}
+	return next.Hex()
+}
+
+// findCode 没有建索引的字段和错误的cursor是请求的问题
+func findCode(err error) (uint32, string) {
+	switch {
+	case err == nil:
+		return protocol.CodeOK, ""
+	case errors.Is(err, kv.ErrNoTraceKey), errors.Is(err, kv.ErrNotIndexed), errors.Is(err, kv.ErrNoTextIndex),
+		errors.Is(err, kv.ErrInvalidQuery), errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidRange):
+		return protocol.CodeBadRequest, err.Error()
+	}
+	return protocol.CodeInternal, err.Error()
+}
+
+// search 全文查询的一页, 时间范围和cursor取更靠后的作为起点
+func (s *Server) search(req *protocol.SearchReq) ([]protocol.GetAck, string, error) {
+	q, err := kv.ParseQuery(req.Query)
+	if err != nil {
+		return nil, "", err
+	}
+	cur, err := scanRange(&protocol.ScanReq{StartTime: req.StartTime, EndTime: req.EndTime})
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidRange, err)
+	}
+	if req.KeysOnly {
+		return s.searchKeys(q, cur, req)
+	}
+	return s.findPage(req.Cursor, req.Limit, func(start primitive.ObjectID, opts kv.ScanOptions) ([][]byte, bool, error) {
+		if bytes.Compare(start[:], cur.Start[:]) < 0 {
+			start = cur.Start
+		}
+		return s.engine.Search(q, start, cur.End, opts)
+	})
+}
+
+// searchKeys 只返回key的全文查询, 不读取文档
+func (s *Server) searchKeys(q *kv.Query, cur scanCursor, req *protocol.SearchReq) ([]protocol.GetAck, string, error) {
+	start, limit, err := pageArgs(req.Cursor, req.Limit)
+	if err != nil {
+		return nil, "", err
+	}
+	if bytes.Compare(start[:], cur.Start[:]) < 0 {
+		start = cur.Start
+	}
+	keys, more, err := s.engine.SearchKeys(q, start, cur.End, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	var batch ackBatch
+	var last primitive.ObjectID
+	for _, key := range keys {
+		if !batch.add(protocol.GetAck{Key: key.Hex()}) {
+			more = true
+			break
+		}
+		last = key
+	}
+	var datas = batch.take()
+	return datas, nextCursor(last, more && len(datas) > 0), nil
+}
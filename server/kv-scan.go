@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"logkv/kv"
+	"logkv/protocol"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultScanLimit = 1000
+	maxScanLimit     = 10 * 1000
+	// 带过滤条件时一页最多检查的条数, 超过后返回已经找到的数据和cursor, 避免一次请求扫描太久
+	maxScanRecords = 100 * 1000
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidRange  = errors.New("invalid range")
+)
+
+// scanCursor 要扫描的范围和过滤条件, 也是返回给客户端的cursor, 服务端不保存状态
+type scanCursor struct {
+	Start   primitive.ObjectID
+	End     primitive.ObjectID
+	Reverse bool
+	Filter  *kv.Filter
+}
+
+// scanRange 把请求里的key或者时间转换成key的范围
+func scanRange(req *protocol.ScanReq) (cur scanCursor, err error) {
+	cur.End = kv.MaxKey
+	cur.Reverse = req.Reverse
+	if req.StartKey != "" {
+		if cur.Start, err = primitive.ObjectIDFromHex(req.StartKey); err != nil {
+			return
+		}
+	} else if req.StartTime > 0 {
+		// 从开始的这一秒最小的key开始
+		cur.Start = primitive.NewObjectIDFromTimestamp(time.Unix(int64(req.StartTime), 0))
+		copy(cur.Start[4:], primitive.NilObjectID[4:])
+	}
+	if req.EndKey != "" {
+		if cur.End, err = primitive.ObjectIDFromHex(req.EndKey); err != nil {
+			return
+		}
+	} else if req.EndTime > 0 {
+		// 包含结束的这一秒
+		cur.End = primitive.NewObjectIDFromTimestamp(time.Unix(int64(req.EndTime), 0))
+		copy(cur.End[4:], kv.MaxKey[4:])
+	}
+	if bytes.Compare(cur.Start[:], cur.End[:]) > 0 {
+		err = errors.New("start after end")
+		return
+	}
+	if len(req.Filter) > 0 {
+		cur.Filter, err = kv.ParseFilter(req.Filter)
+	}
+	return
+}
+
+// cursor 格式: 起始key | 结束key | 倒序标记 | 过滤条件
+// 没有过滤条件时倒序标记为0可以省略
+func (c scanCursor) String() string {
+	var b = make([]byte, 0, 25)
+	b = append(b, c.Start[:]...)
+	b = append(b, c.End[:]...)
+	if c.Reverse {
+		b = append(b, 1)
+	} else if c.Filter != nil {
+		b = append(b, 0)
+	}
+	if c.Filter != nil {
+		b = append(b, c.Filter.Bytes()...)
+	}
+	return hex.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (cur scanCursor, err error) {
+	b, err := hex.DecodeString(cursor)
+	if err != nil || len(b) < 24 {
+		return cur, ErrInvalidCursor
+	}
+	copy(cur.Start[:], b)
+	copy(cur.End[:], b[12:])
+	cur.Reverse = len(b) > 24 && b[24] == 1
+	if len(b) > 25 {
+		if cur.Filter, err = kv.ParseFilter(b[25:]); err != nil {
+			return cur, ErrInvalidCursor
+		}
+	}
+	return cur, nil
+}
+
+// scan 读取一页, 返回下一页的cursor, 读完时cursor为空
+// 不满足过滤条件的数据也算作读过, 下一页从最后读过的数据之后开始
+// proj 不为nil时只返回部分字段
+func (s *Server) scan(cur scanCursor, limit int32, proj *kv.Projection) ([]protocol.GetAck, string, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	var batch ackBatch
+	var scanned int
+	var last primitive.ObjectID
+	var more bool
+	var it = s.engine.NewIterator(cur.Start, cur.End, cur.Reverse)
+	for it.Next() {
+		if len(batch.datas) >= int(limit) || scanned >= maxScanRecords {
+			more = true
+			break
+		}
+		var key, v = it.Key(), it.Value()
+		if cur.Filter != nil && !cur.Filter.Match(v) {
+			scanned++
+			last = key
+			continue
+		}
+		if !batch.add(protocol.GetAck{Key: key.Hex(), Data: proj.Apply(v)}) {
+			more = true
+			break
+		}
+		scanned++
+		last = key
+	}
+	if err := it.Err(); err != nil {
+		return nil, "", err
+	}
+	var datas = batch.take()
+	if !more {
+		return datas, "", nil
+	}
+	var ok bool
+	if cur.Reverse {
+		cur.End, ok = kv.PrevKey(last)
+	} else {
+		cur.Start, ok = kv.NextKey(last)
+	}
+	if !ok || bytes.Compare(cur.Start[:], cur.End[:]) > 0 {
+		return datas, "", nil
+	}
+	return datas, cur.String(), nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"logkv/kv"
+	"logkv/protocol"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rscan 按cursor翻页, 范围跨过多个段和缓存, 缓存里有覆盖了磁盘上的key
+// 开始和结束的key以及按时间给的范围都包含边界
+func TestReverseScan(t *testing.T) {
+	var s = newTestServer(t, kv.WithSegmentSize(2*1024), kv.WithCompression(kv.CompressNone, 1024), kv.WithSyncPolicy(kv.SyncNone, 0))
+	defer s.cleanup()
+
+	const n = 600
+	var ts = time.Now()
+	var keys = make([]primitive.ObjectID, n)
+	var values = make(map[string][]byte)
+	// 时间之后全是0, 第一个key是这一秒里最小的key
+	var base = primitive.NewObjectIDFromTimestamp(ts)
+	copy(base[4:], primitive.NilObjectID[4:])
+	var set = func(i, v int) {
+		var key = base
+		key[10], key[11] = byte(i>>8), byte(i)
+		data, _ := bson.Marshal(bson.M{"_id": key, "i": i, "v": v})
+		if _, err := s.engine.Set(data); err != nil {
+			t.Fatal(err)
+		}
+		keys[i], values[key.Hex()] = key, data
+	}
+	// 偶数重启后落盘, 奇数和每7个偶数的新值在缓存里
+	for i := 0; i < n; i += 2 {
+		set(i, 0)
+	}
+	s.restart()
+	for i := 0; i < n; i++ {
+		if i%2 == 1 {
+			set(i, 0)
+		} else if i%14 == 0 {
+			set(i, 1)
+		}
+	}
+
+	var cases = []struct {
+		name       string
+		req        protocol.ScanReq
+		start, end int
+	}{
+		{"end key on disk", protocol.ScanReq{EndKey: keys[500].Hex()}, 0, 500},
+		{"end key in memory", protocol.ScanReq{EndKey: keys[501].Hex()}, 0, 501},
+		{"both keys", protocol.ScanReq{StartKey: keys[99].Hex(), EndKey: keys[420].Hex()}, 99, 420},
+		{"overwritten bounds", protocol.ScanReq{StartKey: keys[28].Hex(), EndKey: keys[588].Hex()}, 28, 588},
+		{"single key", protocol.ScanReq{StartKey: keys[301].Hex(), EndKey: keys[301].Hex()}, 301, 301},
+		{"time bounds", protocol.ScanReq{StartTime: uint32(ts.Unix()), EndTime: uint32(ts.Unix())}, 0, n - 1},
+	}
+	for _, c := range cases {
+		c.req.Reverse = true
+		cur, err := scanRange(&c.req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var got []protocol.GetAck
+		for {
+			datas, cursor, err := s.scan(cur, 97, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			got = append(got, datas...)
+			if cursor == "" {
+				break
+			}
+			if cur, err = decodeCursor(cursor); err != nil || !cur.Reverse {
+				t.Fatalf("%s: cursor %s: %v", c.name, cursor, err)
+			}
+		}
+		if len(got) != c.end-c.start+1 {
+			t.Fatalf("%s: got %d docs, want %d", c.name, len(got), c.end-c.start+1)
+		}
+		for j, ack := range got {
+			var want = keys[c.end-j].Hex()
+			if ack.Key != want || !bytes.Equal(ack.Data, values[want]) {
+				t.Fatalf("%s: doc %d is %s, want %s", c.name, j, ack.Key, want)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/davyxu/cellnet"
 	"github.com/davyxu/cellnet/peer"
@@ -10,13 +11,83 @@ import (
 	"github.com/davyxu/cellnet/proc"
 )
 
+// sessionQueue 一个连接上等待处理的请求
+// 每个连接一个协程按到达的顺序处理, 同一个连接先发的写入先生效, 不同连接之间并发
+type sessionQueue struct {
+	sync.Mutex
+	msgs   []interface{}
+	notify chan struct{}
+	closed bool
+}
+
+func newSessionQueue() *sessionQueue {
+	return &sessionQueue{notify: make(chan struct{}, 1)}
+}
+
+// push 不阻塞, 事件循环是所有连接共用的
+func (q *sessionQueue) push(msg interface{}) {
+	q.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.Unlock()
+	q.wake()
+}
+
+func (q *sessionQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+	q.wake()
+}
+
+func (q *sessionQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take 取出所有等待的请求, 关闭之后返回false
+func (q *sessionQueue) take() ([]interface{}, bool) {
+	for {
+		q.Lock()
+		var msgs, closed = q.msgs, q.closed
+		q.msgs = nil
+		q.Unlock()
+		if closed {
+			return nil, false
+		}
+		if len(msgs) > 0 {
+			return msgs, true
+		}
+		<-q.notify
+	}
+}
+
+func (s *Server) serve(sess cellnet.Session, q *sessionQueue) {
+	for {
+		msgs, ok := q.take()
+		if !ok {
+			return
+		}
+		for _, msg := range msgs {
+			s.Handle(sess, msg)
+		}
+	}
+}
+
 func (s *Server) AddSession(sess cellnet.Session) {
 	s.Lock()
 	defer s.Unlock()
 	if old, ok := s.session[sess.ID()]; ok {
 		old.Close()
 	}
+	if q, ok := s.queues[sess.ID()]; ok {
+		q.close()
+	}
+	var q = newSessionQueue()
 	s.session[sess.ID()] = sess
+	s.queues[sess.ID()] = q
+	go s.serve(sess, q)
 }
 
 func (s *Server) CloseSession(id int64) {
@@ -25,7 +96,21 @@ func (s *Server) CloseSession(id int64) {
 	if old, ok := s.session[id]; ok {
 		old.Close()
 	}
+	if q, ok := s.queues[id]; ok {
+		q.close()
+	}
 	delete(s.session, id)
+	delete(s.queues, id)
+	s.stopStreams(id)
+}
+
+func (s *Server) enqueue(sess cellnet.Session, msg interface{}) {
+	s.RLock()
+	var q = s.queues[sess.ID()]
+	s.RUnlock()
+	if q != nil {
+		q.push(msg)
+	}
 }
 func (s *Server) GetSession(id int64) cellnet.Session {
 	s.RLock()
@@ -41,18 +126,21 @@ func (s *Server) Listen(port int16) {
 	}()
 	queue := cellnet.NewEventQueue()
 	peerIns := peer.NewGenericPeer("tcp.Acceptor", "server", fmt.Sprintf("0.0.0.0:%d", port), queue)
-	proc.BindProcessorHandler(peerIns, "tcp.ltv", func(ev cellnet.Event) {
-		switch msg := ev.Message().(type) {
-		case *cellnet.SessionAccepted:
-			s.AddSession(ev.Session())
-
-		case *cellnet.SessionClosed:
-			s.CloseSession(ev.Session().ID())
-		default:
-			s.Handle(ev.Session(), msg)
-		}
-	})
+	proc.BindProcessorHandler(peerIns, "tcp.ltv", s.handleEvent)
 	peerIns.Start()
 	s.tcpQueue = queue.StartLoop()
 	s.tcpQueue.Wait()
 }
+
+// handleEvent 连接建立和断开时维护会话, 其他消息放进连接的请求队列
+func (s *Server) handleEvent(ev cellnet.Event) {
+	switch msg := ev.Message().(type) {
+	case *cellnet.SessionAccepted:
+		s.AddSession(ev.Session())
+
+	case *cellnet.SessionClosed:
+		s.CloseSession(ev.Session().ID())
+	default:
+		s.enqueue(ev.Session(), msg)
+	}
+}
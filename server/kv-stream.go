@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"logkv/kv"
+	"logkv/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/davyxu/cellnet"
+)
+
+// 流式扫描: 服务端按块推送 ScanChunk, 每块不超过 MaxPayload
+// 客户端用 StreamNextReq 确认处理完的块, 未确认的块达到窗口大小时暂停发送
+// 最后一块 End 为true, 出错, 取消或者超时也会发送带返回码的最后一块
+const (
+	defaultStreamWindow = 4
+	maxStreamWindow     = 64
+	// 这么长时间没有确认就结束流, 避免客户端不读时一直占着协程
+	streamIdleTimeout = time.Minute
+)
+
+var (
+	errStreamCanceled = errors.New("stream canceled")
+	errStreamTimeout  = errors.New("stream idle timeout")
+	errStreamExists   = errors.New("stream id in use")
+)
+
+type stream struct {
+	id     uint32
+	window int64
+	// 已确认的最大序号, 初始为-1
+	acked  int64
+	notify chan struct{}
+	cancel chan struct{}
+	once   sync.Once
+}
+
+func newStream(id uint32, window int32) *stream {
+	if window <= 0 {
+		window = defaultStreamWindow
+	}
+	if window > maxStreamWindow {
+		window = maxStreamWindow
+	}
+	return &stream{
+		id:     id,
+		window: int64(window),
+		acked:  -1,
+		notify: make(chan struct{}, 1),
+		cancel: make(chan struct{}),
+	}
+}
+
+// ack 确认是累计的, 乱序到达的较小序号忽略
+func (st *stream) ack(seq uint32) {
+	for {
+		var old = atomic.LoadInt64(&st.acked)
+		if int64(seq) <= old || atomic.CompareAndSwapInt64(&st.acked, old, int64(seq)) {
+			break
+		}
+	}
+	select {
+	case st.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (st *stream) stop() {
+	st.once.Do(func() { close(st.cancel) })
+}
+
+// wait 等到序号为seq的块可以发送
+func (st *stream) wait(seq uint32) error {
+	var timer = time.NewTimer(streamIdleTimeout)
+	defer timer.Stop()
+	for int64(seq)-atomic.LoadInt64(&st.acked) > st.window {
+		select {
+		case <-st.notify:
+		case <-st.cancel:
+			return errStreamCanceled
+		case <-timer.C:
+			return errStreamTimeout
+		}
+	}
+	select {
+	case <-st.cancel:
+		return errStreamCanceled
+	default:
+	}
+	return nil
+}
+
+func (s *Server) addStream(sessID int64, st *stream) error {
+	s.Lock()
+	defer s.Unlock()
+	var streams = s.streams[sessID]
+	if streams == nil {
+		streams = make(map[uint32]*stream)
+		s.streams[sessID] = streams
+	}
+	if _, ok := streams[st.id]; ok {
+		return errStreamExists
+	}
+	streams[st.id] = st
+	return nil
+}
+
+func (s *Server) getStream(sessID int64, id uint32) *stream {
+	s.RLock()
+	defer s.RUnlock()
+	return s.streams[sessID][id]
+}
+
+func (s *Server) removeStream(sessID int64, id uint32) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.streams[sessID], id)
+	if len(s.streams[sessID]) == 0 {
+		delete(s.streams, sessID)
+	}
+}
+
+// stopStreams 连接断开时停止上面所有的流, 需要持有 s.Lock
+func (s *Server) stopStreams(sessID int64) {
+	for _, st := range s.streams[sessID] {
+		st.stop()
+	}
+}
+
+func (s *Server) scanStream(sess cellnet.Session, req *protocol.ScanStreamReq) {
+	cur, err := scanRange(&req.ScanReq)
+	var proj *kv.Projection
+	if err == nil {
+		proj, err = kv.NewProjection(req.Include, req.Exclude)
+	}
+	if err != nil {
+		sess.Send(&protocol.ScanChunk{
+			CodeAck:  protocol.CodeAck{Code: protocol.CodeBadRequest, Message: err.Error()},
+			StreamID: req.StreamID,
+			End:      true,
+		})
+		return
+	}
+	var st = newStream(req.StreamID, req.Window)
+	if err := s.addStream(sess.ID(), st); err != nil {
+		sess.Send(&protocol.ScanChunk{
+			CodeAck:  protocol.CodeAck{Code: protocol.CodeBadRequest, Message: err.Error()},
+			StreamID: req.StreamID,
+			End:      true,
+		})
+		return
+	}
+	// 推送要等客户端确认, 放到单独的协程里, 同一个连接上后面的请求照常按顺序处理
+	go s.pushScan(sess, st, cur, req.Limit, proj)
+}
+
+func (s *Server) pushScan(sess cellnet.Session, st *stream, cur scanCursor, limit int32, proj *kv.Projection) {
+	defer s.removeStream(sess.ID(), st.id)
+
+	var chunk = &protocol.ScanChunk{StreamID: st.id}
+	var batch ackBatch
+	var count int
+	var send = func(end bool) error {
+		if err := st.wait(chunk.Seq); err != nil {
+			return err
+		}
+		chunk.Datas, chunk.End = batch.take(), end
+		sess.Send(chunk)
+		chunk = &protocol.ScanChunk{StreamID: st.id, Seq: chunk.Seq + 1}
+		return nil
+	}
+
+	var it = s.engine.NewIterator(cur.Start, cur.End, cur.Reverse)
+	for (limit <= 0 || count < int(limit)) && it.Next() {
+		if cur.Filter != nil && !cur.Filter.Match(it.Value()) {
+			continue
+		}
+		var item = protocol.GetAck{Key: it.Key().Hex(), Data: proj.Apply(it.Value())}
+		if !batch.add(item) {
+			if err := send(false); err != nil {
+				s.endStream(sess, chunk, err)
+				return
+			}
+			batch.add(item)
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		s.endStream(sess, chunk, err)
+		return
+	}
+	if err := send(true); err != nil {
+		s.endStream(sess, chunk, err)
+	}
+}
+
+// endStream 异常结束时发送不带数据的结束块
+func (s *Server) endStream(sess cellnet.Session, chunk *protocol.ScanChunk, err error) {
+	chunk.Datas = nil
+	chunk.End = true
+	chunk.Message = err.Error()
+	switch err {
+	case errStreamCanceled:
+		chunk.Code = protocol.CodeCanceled
+	case errStreamTimeout:
+		chunk.Code = protocol.CodeTimeout
+	case kv.ErrSlowSubscriber:
+		chunk.Code = protocol.CodeOverloaded
+	default:
+		chunk.Code = protocol.CodeInternal
+	}
+	sess.Send(chunk)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"logkv/kv"
+	"logkv/protocol"
+
+	"github.com/davyxu/cellnet"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// subscribe 订阅新数据, 和流式扫描一样按块推送并等待确认, 只是没有结束位置
+// 有数据就发送, 不等攒满一块; 确认跟不上时引擎里的缓冲会满, 订阅以 CodeOverloaded 结束
+func (s *Server) subscribe(sess cellnet.Session, req *protocol.SubscribeReq) {
+	opts, proj, err := subscribeOptions(req)
+	var sub *kv.Subscription
+	if err == nil {
+		sub, err = s.engine.Subscribe(opts)
+	}
+	if err != nil {
+		sess.Send(&protocol.ScanChunk{
+			CodeAck:  protocol.CodeAck{Code: protocol.CodeBadRequest, Message: err.Error()},
+			StreamID: req.StreamID,
+			End:      true,
+		})
+		return
+	}
+	var st = newStream(req.StreamID, req.Window)
+	if err := s.addStream(sess.ID(), st); err != nil {
+		sub.Close()
+		sess.Send(&protocol.ScanChunk{
+			CodeAck:  protocol.CodeAck{Code: protocol.CodeBadRequest, Message: err.Error()},
+			StreamID: req.StreamID,
+			End:      true,
+		})
+		return
+	}
+	// 订阅在这里注册, 同一个连接上之后的写入一定能收到; 推送放到单独的协程里
+	go s.pushSubscription(sess, sub, st, proj)
+}
+
+func (s *Server) pushSubscription(sess cellnet.Session, sub *kv.Subscription, st *stream, proj *kv.Projection) {
+	defer sub.Close()
+	defer s.removeStream(sess.ID(), st.id)
+	defer st.stop()
+	// 取消或者连接断开时让阻塞的 Next 返回, 订阅因为太慢结束时也不再等确认
+	go func() {
+		select {
+		case <-st.cancel:
+		case <-sub.Done():
+		}
+		sub.Close()
+		st.stop()
+	}()
+
+	var chunk = &protocol.ScanChunk{StreamID: st.id}
+	var batch ackBatch
+	var send = func() error {
+		if err := st.wait(chunk.Seq); err != nil {
+			return err
+		}
+		chunk.Datas = batch.take()
+		sess.Send(chunk)
+		chunk = &protocol.ScanChunk{StreamID: st.id, Seq: chunk.Seq + 1}
+		return nil
+	}
+	for sub.Next() {
+		var item = protocol.GetAck{Key: sub.Key().Hex(), Data: proj.Apply(sub.Value())}
+		if !batch.add(item) {
+			if err := send(); err != nil {
+				s.endSubscribe(sess, sub, chunk, err)
+				return
+			}
+			batch.add(item)
+		}
+		if !sub.Ready() {
+			if err := send(); err != nil {
+				s.endSubscribe(sess, sub, chunk, err)
+				return
+			}
+		}
+	}
+	s.endSubscribe(sess, sub, chunk, sub.Err())
+}
+
+// endSubscribe 订阅结束时流也被停止, 太慢导致的结束优先返回 CodeOverloaded
+func (s *Server) endSubscribe(sess cellnet.Session, sub *kv.Subscription, chunk *protocol.ScanChunk, err error) {
+	if sub.Err() == kv.ErrSlowSubscriber {
+		err = kv.ErrSlowSubscriber
+	} else if err == kv.ErrSubscriptionClosed {
+		err = errStreamCanceled
+	}
+	s.endStream(sess, chunk, err)
+}
+
+func subscribeOptions(req *protocol.SubscribeReq) (kv.SubscribeOptions, *kv.Projection, error) {
+	var opts = kv.SubscribeOptions{Trace: req.Trace}
+	var err error
+	if req.Resume != "" {
+		if opts.Resume, err = primitive.ObjectIDFromHex(req.Resume); err != nil {
+			return opts, nil, err
+		}
+	}
+	if len(req.Filter) > 0 {
+		if opts.Filter, err = kv.ParseFilter(req.Filter); err != nil {
+			return opts, nil, err
+		}
+	}
+	proj, err := kv.NewProjection(req.Include, req.Exclude)
+	return opts, proj, err
+}
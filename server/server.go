@@ -11,15 +11,23 @@ import (
 
 type Server struct {
 	sync.RWMutex
-	session  map[int64]cellnet.Session
+	session map[int64]cellnet.Session
+	// 每个连接的请求队列
+	queues map[int64]*sessionQueue
+	// 每个连接上正在进行的流式扫描
+	streams  map[int64]map[uint32]*stream
 	engine   *kv.KvEngine
 	timeout  time.Duration
 	tcpQueue cellnet.EventQueue
+	// 以从节点运行时复制主节点的数据, 为nil时是主节点
+	follower *follower
 }
 
 func NewServer(ctx context.Context, engine *kv.KvEngine) *Server {
 	var s = &Server{
 		session: make(map[int64]cellnet.Session),
+		queues:  make(map[int64]*sessionQueue),
+		streams: make(map[int64]map[uint32]*stream),
 		engine:  engine,
 		timeout: 1 * time.Second,
 	}
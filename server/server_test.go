@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"logkv/kv"
+	"os"
+	"testing"
+)
+
+// testServer 在临时目录里打开引擎的服务端, 可以用同一个目录重新打开
+type testServer struct {
+	*Server
+	dirname string
+	opts    []kv.Option
+	cancel  context.CancelFunc
+}
+
+// newTestServer 在新的临时目录里打开引擎和服务端, 不监听端口, 用完调用 cleanup
+func newTestServer(t *testing.T, opts ...kv.Option) *testServer {
+	t.Helper()
+	dirname, err := ioutil.TempDir("", "logkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = &testServer{dirname: dirname, opts: opts}
+	s.open()
+	return s
+}
+
+func (s *testServer) open() {
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	s.Server = NewServer(ctx, kv.NewKvEngine(ctx, s.dirname, s.opts...))
+}
+
+// restart 关闭引擎后重新打开, 缓存里的数据落盘
+func (s *testServer) restart() {
+	s.engine.Close()
+	s.cancel()
+	s.open()
+}
+
+// cleanup 关闭引擎并删除目录
+func (s *testServer) cleanup() {
+	s.engine.Close()
+	s.cancel()
+	os.RemoveAll(s.dirname)
+}
@@ -75,3 +75,13 @@ func (node *Node) Key() primitive.ObjectID {
 func (node *Node) Val() interface{} {
 	return node.elem
 }
+
+// Next 下一个节点, 没有时返回nil
+func (node *Node) Next() *Node {
+	return node.level[0].forward
+}
+
+// Prev 上一个节点, 没有时返回nil
+func (node *Node) Prev() *Node {
+	return node.backward
+}
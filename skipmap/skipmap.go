@@ -58,9 +58,9 @@ func (m *Skipmap) Last() (*Node, bool) {
 	return f, f != nil
 }
 
-// Set 向跳表中插入一个新的元素。
+// Set 向跳表中插入一个新的元素, key 已经存在时替换它的值。
 // 步骤：
-// 1. 查找插入位置
+// 1. 查找插入位置, key 已经存在时直接替换
 // 2. 创建新节点，并在目标位置插入节点
 // 3. 调整跳表 backward 指针等
 func (m *Skipmap) Set(key primitive.ObjectID, elem interface{}) *Node {
@@ -92,6 +92,11 @@ func (m *Skipmap) Set(key primitive.ObjectID, elem interface{}) *Node {
 		update[i] = cur
 	}
 
+	if next := update[0].level[0].forward; next != nil && next.key == node.key {
+		next.elem = elem
+		return next
+	}
+
 	// 调整跳表高度
 	level := m.randomLevel()
 	if level > m.level {
@@ -302,7 +307,7 @@ func (r *Range) LteMax(v primitive.ObjectID) bool {
 	if r.ExcludeMax {
 		return compareSlice(v, r.Max) < 0
 	}
-	return compareSlice(v, r.Min) <= 0
+	return compareSlice(v, r.Max) <= 0
 }
 
 func (r *Range) isValid() bool {
@@ -350,12 +355,12 @@ func (m *Skipmap) LastInRange(rng Range) *Node {
 	cur := m.header
 	for i := m.level - 1; i >= 0; i-- {
 		// 注意边界情况
-		for cur.level[0].forward != nil && rng.LteMax(cur.level[0].forward.key) {
-			cur = cur.level[0].forward
+		for cur.level[i].forward != nil && rng.LteMax(cur.level[i].forward.key) {
+			cur = cur.level[i].forward
 		}
 	}
 
-	if cur == nil || !rng.GteMin(cur.key) {
+	if cur == m.header || !rng.GteMin(cur.key) {
 		return nil
 	}
 